@@ -0,0 +1,48 @@
+package main
+
+// Bitmap is a set of pieces as sent in the Bitfield message.
+// The high bit of the first byte is piece 0.
+type Bitmap []byte
+
+// Creates an empty bitmap able to hold the given number of pieces
+func NewBitmap(piecesNum int) Bitmap {
+	return make(Bitmap, (piecesNum+7)/8)
+}
+
+// Checks if a piece is in the set
+func (bitmap Bitmap) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitmap) {
+		return false
+	}
+	return bitmap[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+// Adds a piece to the set
+func (bitmap Bitmap) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitmap) {
+		return
+	}
+	bitmap[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+// Removes a piece from the set
+func (bitmap Bitmap) Clear(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitmap) {
+		return
+	}
+	bitmap[byteIndex] &^= 1 << (7 - uint(index%8))
+}
+
+// Counts the pieces in the set
+func (bitmap Bitmap) Count() int {
+	count := 0
+	for _, b := range bitmap {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of peers unchoked for their transfer rate
+	DefaultUploadSlots = 4
+
+	// How often the unchoked peers are chosen again
+	RechokeInterval = 10 * time.Second
+
+	// How often the optimistic unchoke moves to another peer
+	OptimisticUnchokeInterval = 30 * time.Second
+
+	// Peers that send us nothing for this long while we want their data are snubbed
+	SnubTimeout = 60 * time.Second
+)
+
+// Choker decides which peers may download from us, following the
+// tit-for-tat algorithm: the peers giving us the best download rate
+// (or receiving the best upload rate when seeding) are unchoked, plus one
+// rotating optimistic unchoke so that new peers get a chance.
+type Choker struct {
+	UploadSlots int
+	seeding     func() bool
+
+	mu              sync.Mutex
+	peers           map[*PeerConnection]*chokerPeer
+	optimistic      *PeerConnection
+	optimisticSince time.Time
+	lastRechoke     time.Time
+
+	wakeup chan struct{}
+}
+
+// chokerPeer remembers the transfer totals of a peer at the last rechoke
+type chokerPeer struct {
+	downloaded int64
+	uploaded   int64
+	rate       float64
+}
+
+// Creates a choker. seeding reports if we have the whole content.
+func NewChoker(uploadSlots int, seeding func() bool) *Choker {
+	return &Choker{
+		UploadSlots: uploadSlots,
+		seeding:     seeding,
+		peers:       make(map[*PeerConnection]*chokerPeer),
+		lastRechoke: time.Now(),
+		wakeup:      make(chan struct{}, 1),
+	}
+}
+
+// Starts managing a peer, it stays choked until the next rechoke
+func (choker *Choker) Add(peerConnection *PeerConnection) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	choker.peers[peerConnection] = &chokerPeer{}
+}
+
+// Stops managing a peer
+func (choker *Choker) Remove(peerConnection *PeerConnection) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+	delete(choker.peers, peerConnection)
+	if choker.optimistic == peerConnection {
+		choker.optimistic = nil
+	}
+}
+
+// Asks for a rechoke soon, for example when a peer becomes interested
+func (choker *Choker) Trigger() {
+	select {
+	case choker.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Rechokes periodically until done is closed
+func (choker *Choker) Run(done chan struct{}) {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-choker.wakeup:
+		}
+		choker.Rechoke()
+	}
+}
+
+// Checks if a peer has stopped sending us data while we want it
+func isSnubbed(peerConnection *PeerConnection) bool {
+	_, amInterested := peerConnection.interest()
+	_, _, lastBlockAt := peerConnection.Stats.Snapshot()
+	return amInterested && time.Since(lastBlockAt) > SnubTimeout
+}
+
+// Chooses the peers to unchoke and sends the Choke and Unchoke messages.
+// The messages are sent once the lock is released, so that a slow peer
+// does not hold up the peers being added, removed or triggering a rechoke.
+func (choker *Choker) Rechoke() {
+	unchoked := choker.choose()
+	for peerConnection, unchoke := range unchoked {
+		if unchoke {
+			peerConnection.Unchoke()
+		} else {
+			peerConnection.Choke()
+		}
+	}
+}
+
+// Chooses the peers to unchoke. Returns every managed peer, true for the ones to unchoke.
+func (choker *Choker) choose() map[*PeerConnection]bool {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	seeding := choker.seeding()
+
+	// Update the transfer rate of every peer since the last rechoke
+	elapsed := time.Since(choker.lastRechoke).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	choker.lastRechoke = time.Now()
+
+	candidates := []*PeerConnection{}
+	for peerConnection, state := range choker.peers {
+		downloaded, uploaded, _ := peerConnection.Stats.Snapshot()
+		if seeding {
+			state.rate = float64(uploaded-state.uploaded) / elapsed
+		} else {
+			state.rate = float64(downloaded-state.downloaded) / elapsed
+		}
+		state.downloaded, state.uploaded = downloaded, uploaded
+
+		// Snubbed peers only get the optimistic unchoke
+		peerInterested, _ := peerConnection.interest()
+		if peerInterested && (seeding || !isSnubbed(peerConnection)) {
+			candidates = append(candidates, peerConnection)
+		}
+	}
+
+	// The fastest interested peers get the regular upload slots
+	sort.Slice(candidates, func(i, j int) bool {
+		return choker.peers[candidates[i]].rate > choker.peers[candidates[j]].rate
+	})
+	unchoked := make(map[*PeerConnection]bool)
+	for i := 0; i < len(candidates) && i < choker.UploadSlots; i++ {
+		unchoked[candidates[i]] = true
+	}
+
+	// Move the optimistic unchoke to another choked, interested peer every interval
+	if choker.optimistic != nil {
+		peerInterested, _ := choker.optimistic.interest()
+		if !peerInterested || unchoked[choker.optimistic] {
+			choker.optimistic = nil
+		}
+	}
+	if choker.optimistic == nil || time.Since(choker.optimisticSince) >= OptimisticUnchokeInterval {
+		choker.optimistic = choker.pickOptimistic(unchoked)
+		choker.optimisticSince = time.Now()
+	}
+	if choker.optimistic != nil {
+		unchoked[choker.optimistic] = true
+	}
+
+	decisions := make(map[*PeerConnection]bool)
+	for peerConnection := range choker.peers {
+		decisions[peerConnection] = unchoked[peerConnection]
+	}
+	return decisions
+}
+
+// Picks a random interested peer that did not get a regular upload slot
+func (choker *Choker) pickOptimistic(unchoked map[*PeerConnection]bool) *PeerConnection {
+	choices := []*PeerConnection{}
+	for peerConnection := range choker.peers {
+		peerInterested, _ := peerConnection.interest()
+		if peerInterested && !unchoked[peerConnection] && peerConnection != choker.optimistic {
+			choices = append(choices, peerConnection)
+		}
+	}
+	if len(choices) == 0 {
+		// Keep the current optimistic unchoke when nobody else can take it
+		return choker.optimistic
+	}
+	return choices[randomUint32()%uint32(len(choices))]
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns an interested peer whose connection is read by nobody, so that writes block
+func stuckPeerConnection(t *testing.T) *PeerConnection {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	peerConnection := newPeerConnection(&Peer{}, local, make([]byte, 20), [8]byte{})
+	peerConnection.PeerInterested = true
+	return peerConnection
+}
+
+func TestChokerUnchokesInterestedPeers(t *testing.T) {
+	choker := NewChoker(1, func() bool { return true })
+	peers := []*PeerConnection{}
+	for i := 0; i < 3; i++ {
+		local, remote := net.Pipe()
+		go func() {
+			buf := make([]byte, 64)
+			for {
+				if _, err := remote.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		t.Cleanup(func() { local.Close() })
+		peerConnection := newPeerConnection(&Peer{}, local, make([]byte, 20), [8]byte{})
+		peerConnection.PeerInterested = i < 2
+		choker.Add(peerConnection)
+		peers = append(peers, peerConnection)
+	}
+
+	// One regular slot and the optimistic unchoke for the two interested peers
+	choker.Rechoke()
+	for i, peerConnection := range peers {
+		if choking := peerConnection.IsChoking(); choking != (i == 2) {
+			t.Errorf("peer %d: choking = %v, want %v", i, choking, i == 2)
+		}
+	}
+}
+
+func TestChokerRechokeDoesNotHoldTheLock(t *testing.T) {
+	choker := NewChoker(DefaultUploadSlots, func() bool { return true })
+	choker.Add(stuckPeerConnection(t))
+
+	go choker.Rechoke()
+	time.Sleep(50 * time.Millisecond)
+
+	// The Unchoke to the stuck peer is still being written
+	added := make(chan struct{})
+	go func() {
+		choker.Add(stuckPeerConnection(t))
+		choker.Remove(nil)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add blocked while a rechoke was writing to a stuck peer")
+	}
+}
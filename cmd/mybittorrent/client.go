@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 // Decodes a bencoded value
@@ -22,9 +28,20 @@ func PrintDecodeValue(bencodedValue string) {
 func PrintFileInfo(torrent *TorrentFile) {
 	// Print the tracker URL and the file length
 	fmt.Println("Tracker URL:", torrent.Announce)
+	for i, tier := range torrent.AnnounceList {
+		fmt.Printf("Tier %d: %s\n", i, strings.Join(tier, " "))
+	}
 	fmt.Println("Length:", torrent.Info.Length)
 	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
 
+	// Print the files of multi-file torrents
+	if torrent.Info.IsMultiFile() {
+		fmt.Printf("Files:\n")
+		for _, file := range torrent.Info.Files {
+			fmt.Printf("%s (%d)\n", path.Join(file.Path...), file.Length)
+		}
+	}
+
 	// Print the pieces
 	fmt.Printf("Piece Length: %d\n", torrent.Info.PieceLen)
 	fmt.Printf("Piece Hashes:\n")
@@ -33,11 +50,39 @@ func PrintFileInfo(torrent *TorrentFile) {
 	}
 }
 
+// Creates a torrent file for some content and prints its info hash
+func WriteTorrentFile(destFile string, contentPath string, options CreateOptions) {
+	encoded, err := CreateTorrent(contentPath, options)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if destFile == "" {
+		destFile = filepath.Base(filepath.Clean(contentPath)) + ".torrent"
+	}
+	err = os.WriteFile(destFile, []byte(encoded), 0644)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Parse the new torrent back to show the info hash peers will see
+	torrent := ParseFile(destFile)
+	fmt.Printf("Created %s\n", destFile)
+	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
+	fmt.Printf("Piece Length: %d\n", torrent.Info.PieceLen)
+	fmt.Printf("Pieces: %d\n", torrent.NumPieces())
+}
+
 // Prints the peers for the torrent file
 func PrintPeers(torrent *TorrentFile) {
 
-	// Do HTTP GET request to the available peers
+	// Ask the trackers for peers, then tell them we left since we do not download.
+	// The DHT is only searched, we do not announce ourselves to it.
 	peers, err := RequestPeers(torrent)
+	peers, err = withDHTPeers(torrent, peers, err, 0)
+	announceStopped(torrent)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -45,7 +90,7 @@ func PrintPeers(torrent *TorrentFile) {
 
 	// Print the peers
 	for _, peer := range peers {
-		fmt.Printf("%s:%d\n", peer.Ip, peer.Port)
+		fmt.Println(peer.String())
 	}
 }
 
@@ -63,54 +108,112 @@ func DoPeerHandshake(torrent *TorrentFile, peer *Peer) {
 	fmt.Println("Peer ID:", peerConnection.PeerId)
 }
 
-// Downloads a piece from a peer and print the piece hash
-func DownloadPiece(destFile string, torrent *TorrentFile, pieceIndex int) {
-
+// Finds peers for a torrent from its trackers, falling back to the DHT
+// when the trackers give no peers. Private torrents only use their trackers.
+func findPeers(torrent *TorrentFile) ([]Peer, error) {
 	peers, err := RequestPeers(torrent)
-	fmt.Printf("Peers: %v\n", peers)
+	return withDHTPeers(torrent, peers, err, announcePort)
+}
 
-	// Encodes and hash the info
-	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
+// Looks for peers in the DHT when the trackers gave none, except for private torrents.
+// peers and err are the result of the trackers. Tracker warnings are printed and not returned.
+// We are announced to the DHT as listening on port, unless it is 0.
+func withDHTPeers(torrent *TorrentFile, peers []Peer, err error, port int) ([]Peer, error) {
+	var warning *TrackerWarning
+	if errors.As(err, &warning) {
+		fmt.Println(warning)
+		err = nil
+	}
+	if len(peers) > 0 || torrent.Info.Private {
+		return peers, err
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println("Looking for peers in the DHT")
+	dht, err := NewDHT(ListenPort, DHTStatePath())
+	if err != nil {
+		return nil, err
+	}
+	defer dht.Close()
+
+	return dht.GetPeers(torrent.InfoHash, port)
+}
 
-	// Get random peer from the peers list
-	peer := peers[0]
+// Opens a connection with a peer and tells it we want to download.
+// When we serve the torrent, the peer gets our pieces and the returned uploader answers its requests.
+func connectToPeer(torrent *TorrentFile, peer *Peer, served *servedTorrent) (*PeerConnection, *uploader, error) {
 
 	// Do the handshake
 	peerConnection, err := peer.Handshake(torrent.InfoHash)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, nil, err
 	}
 	fmt.Printf("Handshake Peer: %s\n", peerConnection.PeerId)
 
-	defer peerConnection.Conn.Close()
+	// The bitfield of the peer is optional, it may have no pieces yet
+	peerConnection.Bitfield = NewBitmap(torrent.NumPieces())
+	peerConnection.PiecesNum = torrent.NumPieces()
+
+	// Our pieces must be the first message after the handshake
+	var uploads *uploader
+	if served != nil {
+		uploads, err = served.startUploads(peerConnection)
+		if err != nil {
+			peerConnection.Conn.Close()
+			return nil, nil, err
+		}
+	}
+	fail := func(err error) (*PeerConnection, *uploader, error) {
+		if uploads != nil {
+			uploads.Close()
+		}
+		peerConnection.Conn.Close()
+		return nil, nil, err
+	}
 
-	// Exchange multiple peer messages to download the file
-	// Wait for bitfield 5 message
-	messageType, _ := peerConnection.readMessage()
+	if peerConnection.SupportsExtensions() {
+		err = peerConnection.sendExtendedHandshake(len(torrent.Metadata), torrent.Info.Private)
+		if err != nil {
+			return fail(err)
+		}
+	}
 
-	if messageType != Bitfield {
-		fmt.Println("Bitfield message not received!")
-		os.Exit(1)
+	// Send interested message, the peer unchokes us when it wants to
+	err = peerConnection.SetInterested(true)
+	if err != nil {
+		return fail(err)
 	}
 
-	// Send interested message
-	interestedMessage := []byte{0, 0, 0, 1, 2}
-	_, err = peerConnection.Conn.Write(interestedMessage)
+	return peerConnection, uploads, nil
+}
+
+// Downloads a piece from a peer and print the piece hash
+func DownloadPiece(destFile string, torrent *TorrentFile, pieceIndex int) {
+
+	peers, err := findPeers(torrent)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	fmt.Printf("Peers: %v\n", peers)
 
-	// Wait for unchoke message
-	messageType, _ = peerConnection.readMessage()
-	if messageType != Unchoke {
-		fmt.Println("Unchoke message not received!")
-		os.Exit(1)
+	// Encodes and hash the info
+	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
+
+	if pieceIndex < 0 || pieceIndex >= torrent.NumPieces() {
+		fmt.Printf("Piece %d out of range\n", pieceIndex)
+		return
 	}
 
 	// Request piece
-	pieceData, err := peerConnection.RequestPiece(int64(torrent.Info.PieceLen), pieceIndex, int64(torrent.Info.Length))
+	var pieceData []byte
+	downloader := NewDownloader(torrent, peers)
+	err = downloader.Run([]int{pieceIndex}, func(index int, data []byte) error {
+		pieceData = data
+		return nil
+	})
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -128,81 +231,180 @@ func DownloadPiece(destFile string, torrent *TorrentFile, pieceIndex int) {
 	fmt.Printf("Piece %d downloaded to %s\n", pieceIndex, destFile)
 }
 
-// Downloads the file from a peer and print the file hash
-func Download(destFile string, torrent *TorrentFile) {
-
-	peers, err := RequestPeers(torrent)
-	fmt.Printf("Peers: %v\n", peers)
+// Downloads the file from a peer and print the file hash.
+// backlog is the number of block requests kept outstanding with every peer.
+func Download(destFile string, torrent *TorrentFile, backlog int) {
 
-	// Encodes and hash the info
-	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
+	// Look for the data of a previous run before the files are created
+	resume, resumeFound := LoadResumeFile(torrent, destFile)
+	existingData := hasExistingData(torrent, destFile)
 
-	// Get random peer from the peers list
-	peer := peers[0]
-
-	// Do the handshake
-	peerConnection, err := peer.Handshake(torrent.InfoHash)
+	// Open the files where the pieces are written
+	storage, err := OpenStorage(torrent, destFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer storage.Close()
+
+	// Hash-check the pieces already on disk. With a resume file only the
+	// pieces it records as complete need to be checked.
+	piecesNum := torrent.NumPieces()
+	if existingData {
+		candidates := []int{}
+		for i := 0; i < piecesNum; i++ {
+			if !resumeFound || resume.Pieces.Has(i) {
+				candidates = append(candidates, i)
+			}
+		}
+		resume.Pieces = checkPieces(torrent, storage, candidates)
+		fmt.Printf("Resuming with %d/%d pieces already on disk\n", resume.Pieces.Count(), piecesNum)
+	} else {
+		resume.Pieces = NewBitmap(piecesNum)
+	}
+	err = resume.Save()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	fmt.Printf("Handshake Peer: %s\n", peerConnection.PeerId)
 
-	defer peerConnection.Conn.Close()
+	// Dowload the missing pieces
+	pieces := []int{}
+	for i := 0; i < piecesNum; i++ {
+		if !resume.Pieces.Has(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	fmt.Printf("Num of Pieces: %d\n", len(pieces))
 
-	// Exchange multiple peer messages to download the file
-	// Wait for bitfield 5 message
-	messageType, _ := peerConnection.readMessage()
+	// Upload the verified pieces to other peers while downloading
+	server, err := StartServer(ListenPort)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		defer server.Close()
+		server.AddTorrent(torrent, storage, resume.Pieces)
+	}
 
-	if messageType != Bitfield {
-		fmt.Println("Bitfield message not received!")
-		os.Exit(1)
+	if len(pieces) > 0 {
+		err = downloadPieces(torrent, storage, resume, server, pieces, backlog)
+		if err != nil {
+			resume.Save()
+			fmt.Println(err)
+			return
+		}
 	}
 
-	// Send interested message
-	interestedMessage := []byte{0, 0, 0, 1, 2}
-	_, err = peerConnection.Conn.Write(interestedMessage)
+	// The resume file is no longer needed once every piece is on disk
+	err = resume.Remove()
 	if err != nil {
 		fmt.Println(err)
-		return
 	}
 
-	// Wait for unchoke message
-	messageType, _ = peerConnection.readMessage()
-	if messageType != Unchoke {
-		fmt.Println("Unchoke message not received!")
-		os.Exit(1)
+	fmt.Printf("Downloaded %s to %s\n", torrent.Path, destFile)
+}
+
+// Requests peers from the tracker and downloads the given pieces into the storage.
+// The trackers are announced to for as long as the download runs, and give new peers to the downloader.
+func downloadPieces(torrent *TorrentFile, storage *Storage, resume *ResumeFile, server *Server, pieces []int, backlog int) error {
+	torrent.Transfer.SetLeft(torrent.BytesLeft(resume.Pieces))
+	downloader := NewDownloader(torrent, nil)
+	downloader.Backlog = backlog
+	if server != nil {
+		downloader.UploadWith(server)
 	}
 
-	// Dowload all pieces
-	piecesNum := int(torrent.Info.Length / torrent.Info.PieceLen)
-	fmt.Printf("Num of Pieces: %d\n", piecesNum)
-	data := []byte{}
+	// Stop downloading when interrupted, so that the trackers get the stopped event
+	// and the resume file is saved before we exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-signals:
+			downloader.Interrupt()
+		case <-finished:
+		}
+	}()
 
-	for i := 0; i <= piecesNum; i++ {
+	session := NewTrackerSession(torrent)
+	defer session.Stop()
+	peers, err := session.Start(downloader.AddPeers)
+	peers, err = withDHTPeers(torrent, peers, err, announcePort)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Peers: %v\n", peers)
+	downloader.AddPeers(peers)
 
-		fmt.Printf("Downloading piece %d\n", i)
+	// Encodes and hash the info
+	fmt.Printf("Info Hash: %x\n", torrent.InfoHash)
 
-		// Request piece
-		pieceData, err := peerConnection.RequestPiece(int64(torrent.Info.PieceLen), i, int64(torrent.Info.Length))
+	err = downloader.Run(pieces, func(index int, pieceData []byte) error {
+		// Write the piece to its position in the files as soon as it is verified
+		err := storage.WritePiece(index, pieceData)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+		torrent.Transfer.PieceCompleted(len(pieceData))
+		if server != nil {
+			server.PieceCompleted(torrent.InfoHash, index)
 		}
+		return resume.SetPiece(index)
+	})
+	if err != nil {
+		return err
+	}
+	session.Completed()
+	return nil
+}
 
-		fmt.Printf("Downloaded piece %d length: %d\n", i, len(pieceData))
+// Serves the content of a torrent to other peers until interrupted
+func Seed(torrent *TorrentFile, contentPath string, uploadSlots int) {
+	storage, err := OpenStorageReadOnly(torrent, contentPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer storage.Close()
 
-		// Write piece to file
-		data = append(data, pieceData...)
+	// Only the pieces that pass the hash check are served
+	piecesNum := torrent.NumPieces()
+	pieces := make([]int, piecesNum)
+	for i := range pieces {
+		pieces[i] = i
+	}
+	have := checkPieces(torrent, storage, pieces)
+	fmt.Printf("Verified %d/%d pieces\n", have.Count(), piecesNum)
+	if have.Count() == 0 {
+		fmt.Println("Nothing to seed")
+		return
 	}
 
-	file, err := os.Create(destFile)
+	server, err := StartServer(ListenPort)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer file.Close()
-	file.Write(data)
+	defer server.Close()
+	server.UploadSlots = uploadSlots
+	server.AddTorrent(torrent, storage, have)
+	fmt.Printf("Seeding %s on port %d\n", torrent.Info.Name, server.Port())
+
+	// Tell the trackers we have the content until we stop
+	torrent.Transfer.SetLeft(torrent.BytesLeft(have))
+	session := NewTrackerSession(torrent)
+	defer session.Stop()
+	_, err = session.Start(nil)
+	if err != nil {
+		fmt.Println(err)
+	}
 
-	fmt.Printf("Downloaded %s to %s\n", torrent.Path, destFile)
+	// Serve until interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Println("Stopped seeding")
 }
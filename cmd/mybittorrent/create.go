@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Limits of the automatically chosen piece length
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+
+	// Number of pieces the automatic piece length aims for
+	TargetPiecesNum = 1500
+)
+
+// CreateOptions holds the optional fields of a new torrent
+type CreateOptions struct {
+	Announce  [][]string // announce URLs grouped in tiers
+	Comment   string
+	CreatedBy string
+	PieceLen  int // 0 picks the piece length automatically
+	Private   bool
+	WebSeeds  []string
+}
+
+// Picks a power of two piece length giving about TargetPiecesNum pieces
+func choosePieceLength(length int) int {
+	pieceLen := MinPieceLength
+	for length/pieceLen > TargetPiecesNum && pieceLen < MaxPieceLength {
+		pieceLen *= 2
+	}
+	return pieceLen
+}
+
+// Collects the files to put in a torrent.
+// A single file gives a single-file torrent, a directory a multi-file torrent.
+func scanContent(contentPath string) (*Info, error) {
+	fileInfo, err := os.Stat(contentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	info := Info{Name: filepath.Base(filepath.Clean(contentPath))}
+	if !fileInfo.IsDir() {
+		info.Length = int(fileInfo.Size())
+		return &info, nil
+	}
+
+	// Walk the directory in lexical order, keeping only regular files
+	err = filepath.Walk(contentPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(contentPath, filePath)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, File{
+			Length: int(fileInfo.Size()),
+			Path:   strings.Split(filepath.ToSlash(relativePath), "/"),
+		})
+		info.Length += int(fileInfo.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Files) == 0 {
+		return nil, fmt.Errorf("No files found in %s", contentPath)
+	}
+
+	return &info, nil
+}
+
+// Computes the SHA-1 hashes of all the pieces of the content using all CPU cores
+func hashPieces(torrent *TorrentFile, storage *Storage) ([]string, error) {
+	// The storage needs the number of pieces to read them, the hashes are filled in below
+	piecesNum := (torrent.Info.Length + torrent.Info.PieceLen - 1) / torrent.Info.PieceLen
+	pieces := make([]string, piecesNum)
+	torrent.Info.Pieces = pieces
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	jobs := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				data, err := storage.ReadPiece(index)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				hash := sha1.Sum(data)
+				pieces[index] = string(hash[:])
+			}
+		}()
+	}
+
+	for i := 0; i < piecesNum; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return pieces, firstErr
+}
+
+// Builds the bencoded info dictionary
+func encodeInfo(info *Info) map[string]interface{} {
+	infoDict := map[string]interface{}{
+		"name":         info.Name,
+		"piece length": info.PieceLen,
+		"pieces":       strings.Join(info.Pieces, ""),
+	}
+
+	if info.IsMultiFile() {
+		files := []interface{}{}
+		for _, file := range info.Files {
+			path := []interface{}{}
+			for _, component := range file.Path {
+				path = append(path, component)
+			}
+			files = append(files, map[string]interface{}{
+				"length": file.Length,
+				"path":   path,
+			})
+		}
+		infoDict["files"] = files
+	} else {
+		infoDict["length"] = info.Length
+	}
+
+	if info.Private {
+		infoDict["private"] = 1
+	}
+
+	return infoDict
+}
+
+// Creates a torrent file for a file or a directory.
+// Returns the bencoded torrent and an error if any.
+func CreateTorrent(contentPath string, options CreateOptions) (string, error) {
+	info, err := scanContent(contentPath)
+	if err != nil {
+		return "", err
+	}
+	if info.Length == 0 {
+		return "", fmt.Errorf("Cannot create a torrent of empty content")
+	}
+
+	// Pick the piece length
+	info.PieceLen = options.PieceLen
+	if info.PieceLen == 0 {
+		info.PieceLen = choosePieceLength(info.Length)
+	}
+	if info.PieceLen < MinPieceLength || info.PieceLen&(info.PieceLen-1) != 0 {
+		return "", fmt.Errorf("Piece length must be a power of two of at least %d bytes", MinPieceLength)
+	}
+
+	// Hash the content, reading it through the storage layer
+	torrent := TorrentFile{Info: *info}
+	storagePath := contentPath
+	if info.IsMultiFile() {
+		storagePath = filepath.Dir(filepath.Clean(contentPath))
+	}
+	storage, err := OpenStorageReadOnly(&torrent, storagePath)
+	if err != nil {
+		return "", err
+	}
+	defer storage.Close()
+
+	pieces, err := hashPieces(&torrent, storage)
+	if err != nil {
+		return "", err
+	}
+	info.Pieces = pieces
+	info.Private = options.Private
+
+	// Build the torrent dictionary
+	torrentDict := map[string]interface{}{
+		"info":          encodeInfo(info),
+		"creation date": int(time.Now().Unix()),
+	}
+
+	if len(options.Announce) > 0 && len(options.Announce[0]) > 0 {
+		torrentDict["announce"] = options.Announce[0][0]
+	}
+	if len(options.Announce) > 1 || (len(options.Announce) == 1 && len(options.Announce[0]) > 1) {
+		announceList := []interface{}{}
+		for _, tier := range options.Announce {
+			tierList := []interface{}{}
+			for _, url := range tier {
+				tierList = append(tierList, url)
+			}
+			announceList = append(announceList, tierList)
+		}
+		torrentDict["announce-list"] = announceList
+	}
+	if options.Comment != "" {
+		torrentDict["comment"] = options.Comment
+	}
+	if options.CreatedBy != "" {
+		torrentDict["created by"] = options.CreatedBy
+	}
+	if len(options.WebSeeds) > 0 {
+		webSeeds := []interface{}{}
+		for _, url := range options.WebSeeds {
+			webSeeds = append(webSeeds, url)
+		}
+		torrentDict["url-list"] = webSeeds
+	}
+
+	return encodeBencode(torrentDict)
+}
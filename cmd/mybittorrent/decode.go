@@ -8,7 +8,7 @@ import (
 
 // Decodes a Bencode string
 func decodeBencodeString(bencodedString string) (interface{}, int, error) {
-	var stringLenNumberLenght int
+	var stringLenNumberLenght int = -1
 
 	// fmt.Println("To decode string=", bencodedString)
 
@@ -18,19 +18,29 @@ func decodeBencodeString(bencodedString string) (interface{}, int, error) {
 			break
 		}
 	}
+	if stringLenNumberLenght < 0 {
+		return "", -1, fmt.Errorf("Invalid string %s", bencodedString)
+	}
 
-	stringLen, _ := strconv.Atoi(bencodedString[:stringLenNumberLenght])
+	stringLen, err := strconv.Atoi(bencodedString[:stringLenNumberLenght])
+	if err != nil {
+		return "", -1, err
+	}
 
+	// Compare before adding, so that a huge length cannot overflow the end offset
 	start := stringLenNumberLenght + 1
-	end := start + stringLen
+	if stringLen < 0 || stringLen > len(bencodedString)-start {
+		return "", -1, fmt.Errorf("String length %d out of range", stringLen)
+	}
 
+	end := start + stringLen
 	return bencodedString[start:end], end, nil
 }
 
 // Decodes a Bencode integer
 func decodeBencodeInteger(bencodedString string) (interface{}, int, error) {
 	bencodedStringLen := len(bencodedString)
-	var integerLen int
+	var integerLen int = -1
 
 	// fmt.Println("To decode integer=", bencodedString)
 
@@ -41,6 +51,10 @@ func decodeBencodeInteger(bencodedString string) (interface{}, int, error) {
 		}
 	}
 
+	if integerLen < 0 {
+		return "", -1, fmt.Errorf("Unterminated integer %s", bencodedString)
+	}
+
 	start := 1
 	end := integerLen
 
@@ -54,54 +68,74 @@ func decodeBencodeInteger(bencodedString string) (interface{}, int, error) {
 // Decodes a Bencode list
 func decodeBencodeList(bencodedString string) (interface{}, int, error) {
 	var decodedList []interface{} = make([]interface{}, 0)
-	var listLen int = len(bencodedString)
 
 	// fmt.Println("To decode list=", bencodedString)
 
-	// Remove the first (l) and last character (e)
-	bencodedPayload := bencodedString[1 : listLen-1]
+	// Skip the first character (l) and decode values until the closing (e)
+	position := 1
+	for {
+		if position >= len(bencodedString) {
+			return "", -1, fmt.Errorf("Unterminated list")
+		}
+		if bencodedString[position] == 'e' {
+			break
+		}
 
-	for len(bencodedPayload) > 0 {
-		decoded, end, err := decodeBencode(bencodedPayload)
+		decoded, end, err := decodeBencode(bencodedString[position:])
 		if err != nil {
 			return "", -1, err
 		}
 		decodedList = append(decodedList, decoded)
-		bencodedPayload = bencodedPayload[end:]
+		position += end
 	}
 
-	return decodedList, listLen, nil
+	return decodedList, position + 1, nil // +1 to include the 'e' character
 }
 
 // Decodes a Bencode dictionary
 func decodeBencodeDictionary(bencodedString string) (interface{}, int, error) {
 	var decodedDictionary map[string]interface{} = make(map[string]interface{})
-	var dictionaryLen int = len(bencodedString)
-
-	// Remove the first (d) and last character (e)
-	bencodedPayload := bencodedString[1 : dictionaryLen-1]
 
-	for len(bencodedPayload) > 0 {
+	// Skip the first character (d) and decode pairs until the closing (e)
+	position := 1
+	for {
+		if position >= len(bencodedString) {
+			return "", -1, fmt.Errorf("Unterminated dictionary")
+		}
+		if bencodedString[position] == 'e' {
+			break
+		}
 
-		decodedKey, keyEnd, err := decodeBencode(bencodedPayload)
+		decodedKey, keyEnd, err := decodeBencode(bencodedString[position:])
 		if err != nil {
 			return "", -1, err
 		}
+		key, ok := decodedKey.(string)
+		if !ok {
+			return "", -1, fmt.Errorf("Dictionary key is not a string")
+		}
+		position += keyEnd
 
-		decodedValue, valueEnd, err := decodeBencode(bencodedPayload[keyEnd:])
+		if position >= len(bencodedString) {
+			return "", -1, fmt.Errorf("Missing value for key %s", key)
+		}
+		decodedValue, valueEnd, err := decodeBencode(bencodedString[position:])
 		if err != nil {
 			return "", -1, err
 		}
+		position += valueEnd
 
-		decodedDictionary[decodedKey.(string)] = decodedValue
-		bencodedPayload = bencodedPayload[keyEnd+valueEnd:]
+		decodedDictionary[key] = decodedValue
 	}
 
-	return decodedDictionary, dictionaryLen, nil
+	return decodedDictionary, position + 1, nil // +1 to include the 'e' character
 }
 
 // Decodes a Bencode value
 func decodeBencode(bencodedString string) (interface{}, int, error) {
+	if len(bencodedString) == 0 {
+		return "", -1, fmt.Errorf("Empty bencoded value")
+	}
 	if unicode.IsDigit(rune(bencodedString[0])) {
 		return decodeBencodeString(bencodedString)
 	} else if bencodedString[0] == 'i' {
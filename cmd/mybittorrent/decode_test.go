@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeBencode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+		end   int
+	}{
+		{"5:hello", "hello", 7},
+		{"0:", "", 2},
+		{"i52e", 52, 4},
+		{"i-52e", -52, 5},
+		{"l5:helloi52ee", []interface{}{"hello", 52}, 13},
+		{"le", []interface{}{}, 2},
+		{"d3:foo3:bar5:helloi52ee", map[string]interface{}{"foo": "bar", "hello": 52}, 23},
+		{"d1:ald1:bi1eeee", map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": 1}}}, 15},
+		{"4:spamtrailing", "spam", 6},
+	}
+
+	for _, test := range tests {
+		got, end, err := decodeBencode(test.input)
+		if err != nil {
+			t.Errorf("decodeBencode(%q) failed: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) || end != test.end {
+			t.Errorf("decodeBencode(%q) = %#v, %d, want %#v, %d", test.input, got, end, test.want, test.end)
+		}
+	}
+}
+
+func TestDecodeBencodeInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"x",
+		"5:hell",
+		"5hello",
+		"-1:a",
+		"9223372036854775807:abc",
+		"9223372036854775800:x",
+		"99999999999999999999:x",
+		"d1:a9223372036854775800:xe",
+		"l9223372036854775807:e",
+		"i52",
+		"ie",
+		"i1x2e",
+		"l5:hello",
+		"d3:foo",
+		"d3:fooe",
+		"di1e3:bare",
+		"d3:foo3:bar",
+	}
+
+	for _, input := range tests {
+		got, _, err := decodeBencode(input)
+		if err == nil {
+			t.Errorf("decodeBencode(%q) = %#v, want an error", input, got)
+		}
+	}
+}
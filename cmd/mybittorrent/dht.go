@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mainline DHT (BEP 5)
+const (
+	// Nodes per bucket of the routing table
+	DHTBucketSize = 8
+
+	// Queries sent at the same time during a lookup
+	DHTAlpha = 3
+
+	// Time allowed for a node to answer a query
+	DHTQueryTimeout = 5 * time.Second
+
+	// Nodes not heard from for this long are questionable
+	DHTNodeStale = 15 * time.Minute
+
+	// Unanswered queries after which a node is considered bad
+	DHTMaxFailures = 2
+
+	// How often the secret used for tokens changes
+	DHTTokenRotation = 5 * time.Minute
+
+	// Maximum rounds of queries of an iterative lookup
+	DHTMaxLookupRounds = 16
+
+	// Limits of the peers other nodes announce to us, so that they cannot fill our memory.
+	// Past them the oldest peer of a torrent, or a random torrent, is forgotten.
+	DHTMaxStoredTorrents = 1000
+	DHTMaxStoredPeers    = 50 // per torrent, all of them fit in a get_peers response
+
+	// Length of a node in the compact node info format: ID, IPv4 address and port
+	compactNodeLen = 20 + 6
+)
+
+// Well-known nodes used to join the DHT when the routing table is empty
+var DHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// NodeId is the 160-bit identifier of a DHT node
+type NodeId [20]byte
+
+// dhtNode is a node of the routing table
+type dhtNode struct {
+	id       NodeId
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// Checks if a node has stopped answering our queries
+func (node *dhtNode) isBad() bool {
+	return node.failures >= DHTMaxFailures || time.Since(node.lastSeen) > 2*DHTNodeStale
+}
+
+// Returns the XOR distance between two node IDs
+func (id NodeId) distance(other NodeId) NodeId {
+	var result NodeId
+	for i := range id {
+		result[i] = id[i] ^ other[i]
+	}
+	return result
+}
+
+// Returns the number of leading bits two node IDs have in common
+func (id NodeId) commonPrefixLen(other NodeId) int {
+	for i := range id {
+		diff := id[i] ^ other[i]
+		if diff == 0 {
+			continue
+		}
+		prefix := i * 8
+		for diff&0x80 == 0 {
+			prefix++
+			diff <<= 1
+		}
+		return prefix
+	}
+	return len(id) * 8
+}
+
+// Creates a random node ID
+func randomNodeId() NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	return id
+}
+
+// routingTable keeps the known nodes in k-buckets indexed by the
+// length of the prefix they share with our own ID
+type routingTable struct {
+	mu      sync.Mutex
+	own     NodeId
+	buckets [160][]*dhtNode
+}
+
+// Adds a node we heard from, or refreshes it if we already know it.
+// When its bucket is full the node replaces a bad node, if there is one.
+func (table *routingTable) insert(id NodeId, addr *net.UDPAddr) {
+	if id == table.own {
+		return
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	index := table.own.commonPrefixLen(id)
+	bucket := table.buckets[index]
+	for _, node := range bucket {
+		if node.id == id {
+			node.addr = addr
+			node.lastSeen = time.Now()
+			node.failures = 0
+			return
+		}
+	}
+
+	newNode := &dhtNode{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < DHTBucketSize {
+		table.buckets[index] = append(bucket, newNode)
+		return
+	}
+	for i, node := range bucket {
+		if node.isBad() {
+			bucket[i] = newNode
+			return
+		}
+	}
+}
+
+// Records a query the node did not answer
+func (table *routingTable) failed(id NodeId) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	for _, node := range table.buckets[table.own.commonPrefixLen(id)] {
+		if node.id == id {
+			node.failures++
+			return
+		}
+	}
+}
+
+// Returns up to count good nodes closest to the target
+func (table *routingTable) closest(target NodeId, count int) []dhtNode {
+	table.mu.Lock()
+	nodes := []dhtNode{}
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			if !node.isBad() {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+	table.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Returns the number of nodes in the routing table
+func (table *routingTable) size() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	size := 0
+	for _, bucket := range table.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+// Sorts nodes by their distance to the target
+func sortByDistance(nodes []dhtNode, target NodeId) {
+	sort.Slice(nodes, func(i, j int) bool {
+		a := nodes[i].id.distance(target)
+		b := nodes[j].id.distance(target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// Encodes nodes in the compact node info format
+func encodeCompactNodes(nodes []dhtNode) string {
+	var buffer bytes.Buffer
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buffer.Write(node.id[:])
+		buffer.Write(ip)
+		binary.Write(&buffer, binary.BigEndian, uint16(node.addr.Port))
+	}
+	return buffer.String()
+}
+
+// Decodes nodes in the compact node info format
+func decodeCompactNodes(data string) []dhtNode {
+	nodes := []dhtNode{}
+	for i := 0; i+compactNodeLen <= len(data); i += compactNodeLen {
+		var node dhtNode
+		copy(node.id[:], data[i:i+20])
+		node.addr = &net.UDPAddr{
+			IP:   net.IP([]byte(data[i+20 : i+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(data[i+24 : i+26]))),
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// DHT is a node of the mainline DHT, used to find peers without a tracker
+type DHT struct {
+	Id        NodeId
+	conn      *net.UDPConn
+	table     *routingTable
+	statePath string
+
+	mu            sync.Mutex
+	transactionId uint16
+	pending       map[string]chan map[string]interface{}
+	secret        []byte
+	oldSecret     []byte
+	secretChanged time.Time
+	peerStore     map[string][]Peer // peers announced to us by info hash
+
+	done chan struct{}
+}
+
+// Returns the file where the routing table is kept between runs
+func DHTStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "mybittorrent", "dht.state")
+}
+
+// Starts a DHT node listening on a UDP port.
+// The node ID and the routing table are loaded from statePath when it exists.
+func NewDHT(port int, statePath string) (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		// Fall back to any free port
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dht := DHT{
+		Id:        randomNodeId(),
+		conn:      conn,
+		statePath: statePath,
+		pending:   make(map[string]chan map[string]interface{}),
+		peerStore: make(map[string][]Peer),
+		done:      make(chan struct{}),
+	}
+	dht.rotateSecret()
+	dht.loadState()
+	dht.table = &routingTable{own: dht.Id}
+	dht.loadNodes()
+
+	go dht.serve()
+	return &dht, nil
+}
+
+// Returns the local address the node listens on
+func (dht *DHT) Addr() *net.UDPAddr {
+	return dht.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Stops the node and saves its routing table
+func (dht *DHT) Close() error {
+	close(dht.done)
+	err := dht.SaveState()
+	dht.conn.Close()
+	return err
+}
+
+// Reads the state file, returning the decoded dictionary
+func (dht *DHT) readState() map[string]interface{} {
+	if dht.statePath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(dht.statePath)
+	if err != nil {
+		return nil
+	}
+	decoded, _, err := decodeBencode(string(content))
+	if err != nil {
+		return nil
+	}
+	state, _ := decoded.(map[string]interface{})
+	return state
+}
+
+// Restores the node ID saved in the state file
+func (dht *DHT) loadState() {
+	state := dht.readState()
+	if id, ok := state["id"].(string); ok && len(id) == len(dht.Id) {
+		copy(dht.Id[:], id)
+	}
+}
+
+// Restores the nodes saved in the state file in the routing table
+func (dht *DHT) loadNodes() {
+	state := dht.readState()
+	nodes, _ := state["nodes"].(string)
+	for _, node := range decodeCompactNodes(nodes) {
+		dht.table.insert(node.id, node.addr)
+	}
+}
+
+// Saves the node ID and the routing table to the state file
+func (dht *DHT) SaveState() error {
+	if dht.statePath == "" {
+		return nil
+	}
+
+	encoded, err := encodeBencode(map[string]interface{}{
+		"id":    string(dht.Id[:]),
+		"nodes": encodeCompactNodes(dht.table.closest(dht.Id, 20*DHTBucketSize)),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dht.statePath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dht.statePath, []byte(encoded), 0644)
+}
+
+// Changes the secret used to create tokens, keeping the previous one valid
+func (dht *DHT) rotateSecret() {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	dht.oldSecret = dht.secret
+	dht.secret = secret
+	dht.secretChanged = time.Now()
+}
+
+// Creates the token given to a node asking for peers
+func (dht *DHT) makeToken(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip.To16()...))
+	return string(hash[:8])
+}
+
+// Checks a token sent back by a node announcing itself as a peer
+func (dht *DHT) validToken(ip net.IP, token string) bool {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	if token == dht.makeToken(ip, dht.secret) {
+		return true
+	}
+	return dht.oldSecret != nil && token == dht.makeToken(ip, dht.oldSecret)
+}
+
+// Returns a new token for a node
+func (dht *DHT) newToken(ip net.IP) string {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	if time.Since(dht.secretChanged) > DHTTokenRotation {
+		dht.rotateSecret()
+	}
+	return dht.makeToken(ip, dht.secret)
+}
+
+// Sends a KRPC message to a node
+func (dht *DHT) send(addr *net.UDPAddr, message map[string]interface{}) error {
+	encoded, err := encodeBencode(message)
+	if err != nil {
+		return err
+	}
+	_, err = dht.conn.WriteToUDP([]byte(encoded), addr)
+	return err
+}
+
+// Sends a query to a node and waits for its response.
+// Returns the "r" dictionary of the response.
+func (dht *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	dht.mu.Lock()
+	dht.transactionId++
+	var tid [2]byte
+	binary.BigEndian.PutUint16(tid[:], dht.transactionId)
+	key := string(tid[:]) + addr.String()
+	responses := make(chan map[string]interface{}, 1)
+	dht.pending[key] = responses
+	dht.mu.Unlock()
+
+	defer func() {
+		dht.mu.Lock()
+		delete(dht.pending, key)
+		dht.mu.Unlock()
+	}()
+
+	args["id"] = string(dht.Id[:])
+	err := dht.send(addr, map[string]interface{}{
+		"t": string(tid[:]),
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case message := <-responses:
+		if message["y"] == "e" {
+			return nil, fmt.Errorf("DHT error from %s: %v", addr, message["e"])
+		}
+		response, ok := message["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid DHT response from %s", addr)
+		}
+		return response, nil
+	case <-time.After(DHTQueryTimeout):
+		return nil, fmt.Errorf("DHT query to %s timed out", addr)
+	case <-dht.done:
+		return nil, errors.New("DHT closed")
+	}
+}
+
+// Reads KRPC messages, dispatching responses to the pending queries
+// and answering the queries of other nodes
+func (dht *DHT) serve() {
+	buffer := make([]byte, 65536)
+	for {
+		length, addr, err := dht.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-dht.done:
+				return
+			default:
+				continue
+			}
+		}
+		if length == 0 {
+			continue
+		}
+
+		decoded, _, err := decodeBencode(string(buffer[:length]))
+		if err != nil {
+			continue
+		}
+		message, ok := decoded.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tid, _ := message["t"].(string)
+
+		switch message["y"] {
+		case "r", "e":
+			if response, ok := message["r"].(map[string]interface{}); ok {
+				dht.heardFrom(response, addr)
+			}
+			dht.mu.Lock()
+			responses, ok := dht.pending[tid+addr.String()]
+			dht.mu.Unlock()
+			if ok {
+				select {
+				case responses <- message:
+				default:
+				}
+			}
+		case "q":
+			dht.handleQuery(tid, message, addr)
+		}
+	}
+}
+
+// Adds the node that sent a message to the routing table
+func (dht *DHT) heardFrom(dict map[string]interface{}, addr *net.UDPAddr) {
+	id, ok := dict["id"].(string)
+	if !ok || len(id) != 20 {
+		return
+	}
+	var nodeId NodeId
+	copy(nodeId[:], id)
+	dht.table.insert(nodeId, addr)
+}
+
+// Answers a query from another node
+func (dht *DHT) handleQuery(tid string, message map[string]interface{}, addr *net.UDPAddr) {
+	args, ok := message["a"].(map[string]interface{})
+	if !ok {
+		dht.sendError(tid, addr, 203, "Missing arguments")
+		return
+	}
+	dht.heardFrom(args, addr)
+
+	response := map[string]interface{}{"id": string(dht.Id[:])}
+	method, _ := message["q"].(string)
+
+	switch method {
+	case "ping":
+	case "find_node":
+		target, ok := args["target"].(string)
+		if !ok || len(target) != 20 {
+			dht.sendError(tid, addr, 203, "Invalid target")
+			return
+		}
+		var targetId NodeId
+		copy(targetId[:], target)
+		response["nodes"] = encodeCompactNodes(dht.table.closest(targetId, DHTBucketSize))
+	case "get_peers":
+		infoHash, ok := args["info_hash"].(string)
+		if !ok || len(infoHash) != 20 {
+			dht.sendError(tid, addr, 203, "Invalid info hash")
+			return
+		}
+		response["token"] = dht.newToken(addr.IP)
+
+		dht.mu.Lock()
+		peers := dht.peerStore[infoHash]
+		dht.mu.Unlock()
+		if len(peers) > 0 {
+			values := []interface{}{}
+			for _, peer := range peers {
+				if !peer.Addr.Addr().Is4() {
+					continue
+				}
+				value := make([]byte, 6)
+				copy(value, peer.Addr.Addr().AsSlice())
+				binary.BigEndian.PutUint16(value[4:], peer.Addr.Port())
+				values = append(values, string(value))
+			}
+			response["values"] = values
+		} else {
+			var targetId NodeId
+			copy(targetId[:], infoHash)
+			response["nodes"] = encodeCompactNodes(dht.table.closest(targetId, DHTBucketSize))
+		}
+	case "announce_peer":
+		infoHash, ok := args["info_hash"].(string)
+		token, _ := args["token"].(string)
+		if !ok || len(infoHash) != 20 || !dht.validToken(addr.IP, token) {
+			dht.sendError(tid, addr, 203, "Invalid token")
+			return
+		}
+		port, _ := args["port"].(int)
+		if impliedPort, _ := args["implied_port"].(int); impliedPort == 1 {
+			port = addr.Port
+		}
+		if port < 1 || port > 65535 {
+			dht.sendError(tid, addr, 203, "Invalid port")
+			return
+		}
+		dht.storePeer(infoHash, newPeer(addr.IP, port))
+	default:
+		dht.sendError(tid, addr, 204, "Method Unknown")
+		return
+	}
+
+	dht.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": response,
+	})
+}
+
+// Sends a KRPC error
+func (dht *DHT) sendError(tid string, addr *net.UDPAddr, code int, message string) {
+	dht.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, message},
+	})
+}
+
+// Remembers a peer announced for an info hash, within the limits of the store
+func (dht *DHT) storePeer(infoHash string, peer Peer) {
+	dht.mu.Lock()
+	defer dht.mu.Unlock()
+
+	peers, ok := dht.peerStore[infoHash]
+	for _, known := range peers {
+		if known.String() == peer.String() {
+			return
+		}
+	}
+
+	if !ok && len(dht.peerStore) >= DHTMaxStoredTorrents {
+		for other := range dht.peerStore {
+			delete(dht.peerStore, other)
+			break
+		}
+	}
+	if len(peers) >= DHTMaxStoredPeers {
+		peers = append(peers[:0:0], peers[len(peers)-DHTMaxStoredPeers+1:]...)
+	}
+	dht.peerStore[infoHash] = append(peers, peer)
+}
+
+// Pings a node, adding it to the routing table when it answers
+func (dht *DHT) Ping(addr *net.UDPAddr) error {
+	_, err := dht.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// Joins the DHT through the bootstrap nodes and fills the routing table
+// with the nodes closest to our own ID
+func (dht *DHT) Bootstrap(bootstrapNodes []string) {
+	var wg sync.WaitGroup
+	for _, host := range bootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			response, err := dht.query(addr, "find_node", map[string]interface{}{
+				"target": string(dht.Id[:]),
+			})
+			if err != nil {
+				return
+			}
+			nodes, _ := response["nodes"].(string)
+			for _, node := range decodeCompactNodes(nodes) {
+				dht.table.insert(node.id, node.addr)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	dht.lookup(dht.Id, "find_node")
+}
+
+// lookupResult holds what an iterative lookup found
+type lookupResult struct {
+	peers   []Peer
+	tokens  map[string]string // token by node address
+	closest []dhtNode
+}
+
+// Runs an iterative lookup, querying nodes closer and closer to the target.
+// method is find_node to find nodes or get_peers to also collect peers.
+func (dht *DHT) lookup(target NodeId, method string) *lookupResult {
+	result := lookupResult{tokens: make(map[string]string)}
+	candidates := dht.table.closest(target, DHTBucketSize)
+	queried := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+	var mu sync.Mutex
+
+	argName := "target"
+	if method == "get_peers" {
+		argName = "info_hash"
+	}
+
+	for round := 0; round < DHTMaxLookupRounds; round++ {
+		// Query the closest nodes not queried yet
+		mu.Lock()
+		sortByDistance(candidates, target)
+		batch := []dhtNode{}
+		for _, node := range candidates {
+			if len(batch) == DHTAlpha {
+				break
+			}
+			if node.id != dht.Id && !queried[node.addr.String()] {
+				queried[node.addr.String()] = true
+				batch = append(batch, node)
+			}
+		}
+		mu.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func(node dhtNode) {
+				defer wg.Done()
+				response, err := dht.query(node.addr, method, map[string]interface{}{
+					argName: string(target[:]),
+				})
+				if err != nil {
+					dht.table.failed(node.id)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if token, ok := response["token"].(string); ok {
+					result.tokens[node.addr.String()] = token
+					result.closest = append(result.closest, node)
+				}
+				nodes, _ := response["nodes"].(string)
+				candidates = append(candidates, decodeCompactNodes(nodes)...)
+
+				values, _ := response["values"].([]interface{})
+				for _, value := range values {
+					compact, ok := value.(string)
+					if !ok {
+						continue
+					}
+					for _, peer := range parseCompactPeers([]byte(compact), net.IPv4len) {
+						if !seenPeers[peer.String()] {
+							seenPeers[peer.String()] = true
+							result.peers = append(result.peers, peer)
+						}
+					}
+				}
+			}(node)
+		}
+		wg.Wait()
+	}
+
+	sortByDistance(result.closest, target)
+	if len(result.closest) > DHTBucketSize {
+		result.closest = result.closest[:DHTBucketSize]
+	}
+	return &result
+}
+
+// Finds peers for an info hash and announces ourselves as a peer
+// listening on port to the closest nodes. Nothing is announced when port is 0.
+func (dht *DHT) GetPeers(infoHash []byte, port int) ([]Peer, error) {
+	if dht.table.size() == 0 {
+		dht.Bootstrap(DHTBootstrapNodes)
+	}
+	if dht.table.size() == 0 {
+		return nil, fmt.Errorf("DHT has no nodes")
+	}
+
+	var target NodeId
+	copy(target[:], infoHash)
+	result := dht.lookup(target, "get_peers")
+	if port == 0 {
+		return result.peers, nil
+	}
+
+	// Announce ourselves to the closest nodes that gave us a token
+	var wg sync.WaitGroup
+	for _, node := range result.closest {
+		wg.Add(1)
+		go func(node dhtNode) {
+			defer wg.Done()
+			dht.query(node.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash),
+				"port":      port,
+				"token":     result.tokens[node.addr.String()],
+			})
+		}(node)
+	}
+	wg.Wait()
+
+	return result.peers, nil
+}
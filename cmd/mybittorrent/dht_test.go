@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// Starts a DHT node on a free port, without a state file
+func newTestDHT(t *testing.T) *DHT {
+	dht, err := NewDHT(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dht.Close() })
+	return dht
+}
+
+// Returns the loopback address of a node
+func loopbackAddr(dht *DHT) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: dht.Addr().Port}
+}
+
+func TestDHTQueries(t *testing.T) {
+	server := newTestDHT(t)
+	client := newTestDHT(t)
+	addr := loopbackAddr(server)
+	infoHash := strings.Repeat("\xaa", 20)
+
+	response, err := client.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response["id"] != string(server.Id[:]) {
+		t.Errorf("ping returned id %x, want %x", response["id"], server.Id)
+	}
+
+	// The client answered through its own socket, so the server learnt it
+	if server.table.size() != 1 {
+		t.Errorf("server knows %d nodes, want 1", server.table.size())
+	}
+
+	response, err = client.query(addr, "find_node", map[string]interface{}{"target": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := response["nodes"].(string); len(nodes) != compactNodeLen {
+		t.Errorf("find_node returned %d bytes of nodes, want %d", len(nodes), compactNodeLen)
+	}
+
+	response, err = client.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := response["token"].(string)
+	if !ok || token == "" {
+		t.Fatalf("get_peers returned no token: %v", response)
+	}
+	if _, ok := response["values"]; ok {
+		t.Errorf("get_peers returned values before any announce: %v", response["values"])
+	}
+
+	_, err = client.query(addr, "announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 6000, "token": token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := response["values"].([]interface{})
+	if len(values) != 1 || values[0] != "\x7f\x00\x00\x01\x17\x70" {
+		t.Errorf("get_peers returned values %q, want 127.0.0.1:6000", values)
+	}
+}
+
+func TestDHTRejectsInvalidQueries(t *testing.T) {
+	server := newTestDHT(t)
+	client := newTestDHT(t)
+	addr := loopbackAddr(server)
+	infoHash := strings.Repeat("\xbb", 20)
+
+	response, err := client.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := response["token"].(string)
+
+	tests := []struct {
+		method string
+		args   map[string]interface{}
+		code   string
+	}{
+		{"find_node", map[string]interface{}{"target": "short"}, "203"},
+		{"get_peers", map[string]interface{}{}, "203"},
+		{"announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 6000, "token": "wrong"}, "203"},
+		{"announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 0, "token": token}, "203"},
+		{"announce_peer", map[string]interface{}{"info_hash": infoHash, "port": 65536, "token": token}, "203"},
+		{"announce_peer", map[string]interface{}{"info_hash": infoHash, "port": -1, "token": token}, "203"},
+		{"vote", map[string]interface{}{}, "204"},
+	}
+
+	for _, test := range tests {
+		_, err := client.query(addr, test.method, test.args)
+		if err == nil || !strings.Contains(err.Error(), "["+test.code+" ") {
+			t.Errorf("%s %v: got error %v, want code %s", test.method, test.args, err, test.code)
+		}
+	}
+
+	server.mu.Lock()
+	stored := len(server.peerStore)
+	server.mu.Unlock()
+	if stored != 0 {
+		t.Errorf("invalid announces stored peers for %d torrents", stored)
+	}
+}
+
+func TestDHTPeerStoreLimits(t *testing.T) {
+	dht := &DHT{peerStore: make(map[string][]Peer)}
+	infoHash := strings.Repeat("\xcc", 20)
+
+	for port := 1; port <= DHTMaxStoredPeers+10; port++ {
+		dht.storePeer(infoHash, newPeer(net.IPv4(10, 0, 0, 1), port))
+	}
+	dht.storePeer(infoHash, newPeer(net.IPv4(10, 0, 0, 1), DHTMaxStoredPeers+10))
+	peers := dht.peerStore[infoHash]
+	if len(peers) != DHTMaxStoredPeers {
+		t.Fatalf("stored %d peers, want %d", len(peers), DHTMaxStoredPeers)
+	}
+	if peers[0].Addr.Port() != 11 || peers[len(peers)-1].Addr.Port() != DHTMaxStoredPeers+10 {
+		t.Errorf("stored ports %d to %d, want the newest ones", peers[0].Addr.Port(), peers[len(peers)-1].Addr.Port())
+	}
+
+	for i := 0; i < DHTMaxStoredTorrents+10; i++ {
+		dht.storePeer(string(rune(i))+infoHash, newPeer(net.IPv4(10, 0, 0, 1), 1))
+	}
+	if len(dht.peerStore) != DHTMaxStoredTorrents {
+		t.Errorf("stored %d torrents, want %d", len(dht.peerStore), DHTMaxStoredTorrents)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of peers we download from at the same time
+	MaxPeerConnections = 30
+
+	// Time allowed to download a single piece before the peer is dropped
+	PieceTimeout = 60 * time.Second
+)
+
+// pieceResult is a verified piece downloaded by a peer
+type pieceResult struct {
+	index int
+	data  []byte
+}
+
+// downloadPeer is a connection we download from, with the blocks requested from it
+type downloadPeer struct {
+	peer *Peer
+	conn *PeerConnection
+
+	mu      sync.Mutex
+	pending map[blockRequest]bool
+}
+
+// Removes a block from the pending requests, returns false if it was not requested
+func (peer *downloadPeer) take(request blockRequest) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if !peer.pending[request] {
+		return false
+	}
+	delete(peer.pending, request)
+	return true
+}
+
+// Removes and returns all the pending requests
+func (peer *downloadPeer) takeAll() []blockRequest {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	requests := []blockRequest{}
+	for request := range peer.pending {
+		requests = append(requests, request)
+	}
+	peer.pending = make(map[blockRequest]bool)
+	return requests
+}
+
+// Returns the number of pending requests
+func (peer *downloadPeer) pendingCount() int {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return len(peer.pending)
+}
+
+// Cancels a request after the block arrived from another peer
+func (peer *downloadPeer) cancel(request blockRequest) {
+	if peer.take(request) {
+		peer.conn.sendCancel(request.index, int64(request.begin), int64(request.length))
+	}
+}
+
+// Downloader fetches pieces from many peers at once.
+// The blocks requested from every peer are chosen by a shared piece picker,
+// and given back to it when a peer disconnects, chokes us or sends corrupt data.
+// Besides the initial peers, peers learnt with ut_pex are connected to as slots free up.
+type Downloader struct {
+	torrent  *TorrentFile
+	bans     *BanList
+	MaxPeers int
+	Backlog  int // outstanding block requests per peer
+
+	peersMu   sync.Mutex
+	known     map[string]bool // every peer ever queued, by address
+	queue     []*Peer         // peers waiting for a connection slot
+	connected map[string]Peer // peers we are downloading from
+	added     chan struct{}
+
+	// The torrent as served by our server, nil when we do not upload
+	served *servedTorrent
+
+	picker  *PiecePicker
+	results chan pieceResult
+	done    chan struct{}
+
+	interrupted   chan struct{}
+	interruptOnce sync.Once
+}
+
+// Creates a downloader for the given peers
+func NewDownloader(torrent *TorrentFile, peers []Peer) *Downloader {
+	downloader := &Downloader{
+		torrent:     torrent,
+		bans:        NewBanList(),
+		MaxPeers:    MaxPeerConnections,
+		Backlog:     DefaultBacklog,
+		known:       make(map[string]bool),
+		connected:   make(map[string]Peer),
+		added:       make(chan struct{}, 1),
+		interrupted: make(chan struct{}),
+	}
+	downloader.AddPeers(peers)
+	return downloader
+}
+
+// Uploads to the peers we download from through the server of the torrent:
+// they get our pieces, and the choker of the server unchokes them by their download rate
+func (downloader *Downloader) UploadWith(server *Server) {
+	downloader.served = server.lookup(downloader.torrent.InfoHash)
+}
+
+// Makes Run return before the pieces are all downloaded
+func (downloader *Downloader) Interrupt() {
+	downloader.interruptOnce.Do(func() {
+		close(downloader.interrupted)
+	})
+}
+
+// Queues peers we did not know yet for a connection
+func (downloader *Downloader) AddPeers(peers []Peer) {
+	downloader.peersMu.Lock()
+	defer downloader.peersMu.Unlock()
+
+	for i := range peers {
+		peer := peers[i]
+		key := peer.String()
+		if downloader.known[key] || peer.Addr.Port() == 0 {
+			continue
+		}
+		downloader.known[key] = true
+		downloader.queue = append(downloader.queue, &peer)
+	}
+
+	select {
+	case downloader.added <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the next queued peer, returns nil when the queue is empty
+func (downloader *Downloader) nextPeer() *Peer {
+	downloader.peersMu.Lock()
+	defer downloader.peersMu.Unlock()
+
+	for len(downloader.queue) > 0 {
+		peer := downloader.queue[0]
+		downloader.queue = downloader.queue[1:]
+		if !downloader.bans.IsBanned(peer) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Records whether we are connected to a peer, for the peer lists sent with ut_pex
+func (downloader *Downloader) setConnected(peer *Peer, connected bool) {
+	downloader.peersMu.Lock()
+	defer downloader.peersMu.Unlock()
+	if connected {
+		downloader.connected[peer.String()] = *peer
+	} else {
+		delete(downloader.connected, peer.String())
+	}
+}
+
+// Returns the peers we are connected to, except the given one
+func (downloader *Downloader) connectedPeers(except *Peer) map[string]Peer {
+	downloader.peersMu.Lock()
+	defer downloader.peersMu.Unlock()
+	peers := make(map[string]Peer)
+	for key, peer := range downloader.connected {
+		if key != except.String() {
+			peers[key] = peer
+		}
+	}
+	return peers
+}
+
+// Downloads the given pieces, calling onPiece for every verified piece.
+// Returns once all the pieces are verified, no peers are left or the download is interrupted.
+func (downloader *Downloader) Run(pieces []int, onPiece func(index int, data []byte) error) error {
+	if len(pieces) == 0 {
+		return nil
+	}
+
+	downloader.picker = NewPiecePicker(downloader.torrent, pieces)
+	downloader.results = make(chan pieceResult)
+	downloader.done = make(chan struct{})
+	defer close(downloader.done)
+
+	// Connect to queued peers while there are free slots
+	active := 0
+	exited := make(chan struct{})
+	connectPeers := func() {
+		for active < downloader.MaxPeers {
+			peer := downloader.nextPeer()
+			if peer == nil {
+				return
+			}
+			active++
+			go func() {
+				err := downloader.runPeer(peer)
+				if err != nil {
+					fmt.Printf("Peer %s: %v\n", peer, err)
+				}
+				select {
+				case exited <- struct{}{}:
+				case <-downloader.done:
+				}
+			}()
+		}
+	}
+	connectPeers()
+	if active == 0 {
+		return fmt.Errorf("No peers available")
+	}
+
+	// Collect the pieces until all of them are verified
+	remaining := len(pieces)
+	for remaining > 0 {
+		select {
+		case result := <-downloader.results:
+			err := onPiece(result.index, result.data)
+			if err != nil {
+				return err
+			}
+			remaining--
+			fmt.Printf("Downloaded piece %d (%d/%d)\n", result.index, len(pieces)-remaining, len(pieces))
+		case <-exited:
+			active--
+			connectPeers()
+			if active == 0 {
+				return fmt.Errorf("No peers left with %d pieces remaining", remaining)
+			}
+		case <-downloader.added:
+			connectPeers()
+		case <-downloader.interrupted:
+			return fmt.Errorf("Download interrupted with %d pieces remaining", remaining)
+		}
+	}
+
+	return nil
+}
+
+// Checks if the download has finished
+func (downloader *Downloader) isDone() bool {
+	select {
+	case <-downloader.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Downloads blocks from a single peer until the work is done or the peer fails
+func (downloader *Downloader) runPeer(peer *Peer) error {
+	peerConnection, uploads, err := connectToPeer(downloader.torrent, peer, downloader.served)
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Conn.Close()
+	if uploads != nil {
+		defer uploads.Close()
+	}
+
+	// Unblock any pending read as soon as the download finishes
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-downloader.done:
+			peerConnection.Conn.Close()
+		case <-stop:
+		}
+	}()
+
+	downloadPeer := &downloadPeer{
+		peer:    peer,
+		conn:    peerConnection,
+		pending: make(map[blockRequest]bool),
+	}
+	defer downloader.picker.RemovePeer(downloadPeer)
+
+	// Exchange peers with ut_pex, except for private torrents
+	var pex *pexState
+	if !downloader.torrent.Info.Private {
+		pex = newPexState()
+		peerConnection.HandleExtension("ut_pex", func(peerConnection *PeerConnection, payload []byte) error {
+			peers, err := parsePex(payload)
+			if err != nil {
+				return err
+			}
+			downloader.AddPeers(peers)
+			return nil
+		})
+	}
+	downloader.setConnected(peer, true)
+	defer downloader.setConnected(peer, false)
+
+	// Never ask for more than the peer accepts
+	backlog := downloader.Backlog
+	if backlog < 1 {
+		backlog = 1
+	}
+	if peerConnection.MaxRequests > 0 && backlog > peerConnection.MaxRequests {
+		backlog = peerConnection.MaxRequests
+	}
+	go peerConnection.keepAlive(stop)
+
+	for {
+		if downloader.isDone() {
+			return nil
+		}
+		if downloader.bans.IsBanned(peer) {
+			return fmt.Errorf("banned after sending %d corrupt pieces", MaxHashFailures)
+		}
+
+		// Keep the pipeline full. While choked only the allowed fast pieces are requested.
+		for downloadPeer.pendingCount() < backlog {
+			request, ok := downloader.picker.Pick(downloadPeer)
+			if !ok {
+				break
+			}
+			downloadPeer.mu.Lock()
+			downloadPeer.pending[request] = true
+			downloadPeer.mu.Unlock()
+
+			err = peerConnection.sendRequest(request.index, int64(request.begin), int64(request.length))
+			if err != nil {
+				return err
+			}
+		}
+
+		if pex != nil && pex.due() && peerConnection.HasExtension("ut_pex") {
+			err = pex.send(peerConnection, downloader.connectedPeers(peer))
+			if err != nil {
+				return err
+			}
+		}
+
+		// Wait for blocks, or poll for new work when the peer has nothing we need.
+		// While choked we still wake up to send our peer list.
+		idle := downloadPeer.pendingCount() == 0
+		if idle && peerConnection.IsChoked() {
+			peerConnection.Conn.SetReadDeadline(time.Now().Add(PexInterval))
+		} else if idle {
+			peerConnection.Conn.SetReadDeadline(time.Now().Add(time.Second))
+		} else {
+			peerConnection.Conn.SetReadDeadline(time.Now().Add(PieceTimeout))
+		}
+
+		messageType, payload, err := peerConnection.readMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && idle {
+				continue
+			}
+			if downloader.isDone() {
+				return nil
+			}
+			return err
+		}
+
+		// Pieces announced again by the peer are only counted once
+		newPiece := false
+		if messageType == Have && len(payload) == 4 {
+			newPiece = !peerConnection.Bitfield.Has(int(binary.BigEndian.Uint32(payload)))
+		}
+
+		err = peerConnection.handleMessage(messageType, payload)
+		if err != nil {
+			return err
+		}
+		if uploads != nil {
+			err = uploads.handleMessage(messageType, payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch messageType {
+		case Bitfield, HaveAll:
+			downloader.picker.AddBitfield(peerConnection.Bitfield)
+		case Piece:
+			err = downloader.handleBlock(downloadPeer, payload)
+			if err != nil {
+				return err
+			}
+		case Have:
+			if newPiece {
+				downloader.picker.AddHave(int(binary.BigEndian.Uint32(payload)))
+			}
+		case Choke:
+			// Without the Fast Extension the peer drops our requests, give them
+			// to the other peers. With it the peer rejects the ones it drops.
+			if !peerConnection.SupportsFast() {
+				downloader.picker.Unrequest(downloadPeer, downloadPeer.takeAll())
+			}
+		case Reject:
+			request, _ := parseBlockRequest(payload)
+			if downloadPeer.take(request) {
+				downloader.picker.Unrequest(downloadPeer, []blockRequest{request})
+			}
+		}
+	}
+}
+
+// Stores a block received from a peer, cancels it on the other peers it was
+// requested from and verifies the piece once all of its blocks are received
+func (downloader *Downloader) handleBlock(downloadPeer *downloadPeer, payload []byte) error {
+	request := blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: len(payload) - 8,
+	}
+
+	// Blocks we did not ask for, or cancelled, are ignored
+	if !downloadPeer.take(request) {
+		return nil
+	}
+	downloadPeer.conn.Stats.AddDownloaded(request.length)
+	downloader.torrent.Transfer.AddDownloaded(request.length)
+
+	cancels, data := downloader.picker.Received(downloadPeer, request, payload[8:])
+	for _, other := range cancels {
+		other.cancel(request)
+	}
+	if data == nil {
+		return nil
+	}
+
+	// Discard corrupt pieces so that they are downloaded again from other peers
+	if !downloader.torrent.VerifyPiece(request.index, data) {
+		peer, cancels := downloader.picker.PieceFailed(request.index)
+		for _, cancel := range cancels {
+			cancel.peer.cancel(cancel.request)
+		}
+		if peer == nil {
+			fmt.Printf("Piece %d from several peers failed the hash check\n", request.index)
+			return nil
+		}
+		fmt.Printf("Piece %d from %s failed the hash check\n", request.index, peer)
+		downloader.bans.RecordHashFailure(peer)
+		return nil
+	}
+	downloader.picker.PieceVerified(request.index)
+
+	select {
+	case downloader.results <- pieceResult{index: request.index, data: data}:
+	case <-downloader.done:
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// Message type of the extension protocol (BEP 10)
+	Extended MessageType = 20
+
+	// Extended message id of the extended handshake
+	ExtendedHandshakeId = 0
+
+	// Client name and version sent in the extended handshake
+	ClientVersion = "mybittorrent 0.1"
+)
+
+// ExtensionHandler handles an extended message received for an extension,
+// the payload does not include the extended message id
+type ExtensionHandler func(peerConnection *PeerConnection, payload []byte) error
+
+// Extensions we support, by name, with the extended message id we assign to each.
+// Peers send us the messages of an extension with our id, and we send them
+// with the id the peer assigned in its extended handshake.
+var (
+	localExtensionIds   = make(map[string]int)
+	localExtensionNames = make(map[int]string)
+	publicExtensions    = make(map[string]bool) // not advertised for private torrents
+)
+
+// Extended message id we assign to ut_metadata
+var LocalMetadataId = registerExtension("ut_metadata", true)
+
+// Adds an extension to the ones we advertise and returns its extended message id.
+// allowPrivate tells if the extension may be used with private torrents.
+func registerExtension(name string, allowPrivate bool) int {
+	id := len(localExtensionIds) + 1
+	localExtensionIds[name] = id
+	localExtensionNames[id] = name
+	if !allowPrivate {
+		publicExtensions[name] = true
+	}
+	return id
+}
+
+// Checks if the peer advertised the extension protocol in its handshake
+func (peerConnection *PeerConnection) SupportsExtensions() bool {
+	return peerConnection.Reserved[5]&0x10 != 0
+}
+
+// Sets the handler called for the extended messages of an extension on this connection
+func (peerConnection *PeerConnection) HandleExtension(name string, handler ExtensionHandler) {
+	if peerConnection.extensionHandlers == nil {
+		peerConnection.extensionHandlers = make(map[string]ExtensionHandler)
+	}
+	peerConnection.extensionHandlers[name] = handler
+}
+
+// Checks if the peer supports an extension, by its extended handshake
+func (peerConnection *PeerConnection) HasExtension(name string) bool {
+	_, ok := peerConnection.Extensions[name]
+	return ok
+}
+
+// Sends an extended message with a bencoded payload followed by optional raw data
+func (peerConnection *PeerConnection) sendExtended(extendedId int, payload map[string]interface{}, data []byte) error {
+	encoded, err := encodeBencode(payload)
+	if err != nil {
+		return err
+	}
+
+	message := []byte{byte(extendedId)}
+	message = append(message, encoded...)
+	message = append(message, data...)
+	_, err = peerConnection.sendMessage(Extended, message)
+	return err
+}
+
+// Sends a message of an extension with the id the peer assigned to it
+func (peerConnection *PeerConnection) SendExtension(name string, payload map[string]interface{}, data []byte) error {
+	extendedId, ok := peerConnection.Extensions[name]
+	if !ok {
+		return fmt.Errorf("Peer %s does not support %s", peerConnection.Peer, name)
+	}
+	return peerConnection.sendExtended(extendedId, payload, data)
+}
+
+// Sends the extended handshake advertising the extensions we support.
+// metadataSize is the size of the info dictionary, or 0 when we do not have it.
+// Extensions that leak peers outside of the trackers are left out for private torrents.
+func (peerConnection *PeerConnection) sendExtendedHandshake(metadataSize int, private bool) error {
+	m := make(map[string]interface{})
+	for name, id := range localExtensionIds {
+		if !private || !publicExtensions[name] {
+			m[name] = id
+		}
+	}
+
+	handshake := map[string]interface{}{
+		"m":    m,
+		"v":    ClientVersion,
+		"p":    announcePort,
+		"reqq": MaxQueuedRequests,
+	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
+
+	// Tell the peer the address we see it with
+	if addr := remotePeer(peerConnection.Conn).Addr.Addr(); addr.IsValid() {
+		handshake["yourip"] = string(addr.AsSlice())
+	}
+
+	return peerConnection.sendExtended(ExtendedHandshakeId, handshake, nil)
+}
+
+// Parses the bencoded dictionary at the start of an extended message payload.
+// Returns the dictionary and the raw data that follows it.
+func parseExtendedPayload(payload []byte) (map[string]interface{}, []byte, error) {
+	decoded, end, err := decodeBencode(string(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Extended message is not a dictionary")
+	}
+	return dict, payload[end:], nil
+}
+
+// Dispatches an extended message to the handshake or to the handler of its extension.
+// Messages of extensions without a handler on this connection are ignored.
+func (peerConnection *PeerConnection) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("Invalid extended message from %s", peerConnection.Peer)
+	}
+	if payload[0] == ExtendedHandshakeId {
+		return peerConnection.handleExtendedHandshake(payload[1:])
+	}
+
+	name, ok := localExtensionNames[int(payload[0])]
+	if !ok {
+		return nil
+	}
+	handler, ok := peerConnection.extensionHandlers[name]
+	if !ok {
+		return nil
+	}
+	return handler(peerConnection, payload[1:])
+}
+
+// Handles the extended handshake of the peer, recording the message ids
+// it assigned to each extension and the other fields it sent.
+// A later handshake updates the fields it contains.
+func (peerConnection *PeerConnection) handleExtendedHandshake(payload []byte) error {
+	dict, _, err := parseExtendedPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	if peerConnection.Extensions == nil {
+		peerConnection.Extensions = make(map[string]int)
+	}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			id, ok := id.(int)
+			if !ok {
+				continue
+			}
+
+			// An id of 0 disables the extension
+			if id > 0 && id < 256 {
+				peerConnection.Extensions[name] = id
+			} else {
+				delete(peerConnection.Extensions, name)
+			}
+		}
+	}
+	if metadataSize, ok := dict["metadata_size"].(int); ok {
+		peerConnection.MetadataSize = metadataSize
+	}
+	if version, ok := dict["v"].(string); ok {
+		peerConnection.Client = version
+	}
+	if port, ok := dict["p"].(int); ok && port > 0 && port < 65536 {
+		peerConnection.ListenPort = port
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		peerConnection.MaxRequests = reqq
+	}
+	if yourIp, ok := dict["yourip"].(string); ok && (len(yourIp) == 4 || len(yourIp) == 16) {
+		peerConnection.YourIp = net.IP(yourIp)
+	}
+
+	return nil
+}
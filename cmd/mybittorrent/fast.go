@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Message types of the Fast Extension (BEP 6)
+const (
+	Suggest     MessageType = 13
+	HaveAll     MessageType = 14
+	HaveNone    MessageType = 15
+	Reject      MessageType = 16
+	AllowedFast MessageType = 17
+)
+
+const (
+	// Number of pieces in the allowed fast set we give to a peer
+	AllowedFastSetSize = 10
+
+	// Most pieces suggested by a peer that we remember
+	MaxSuggestedPieces = 16
+)
+
+// Checks if the peer advertised the Fast Extension in its handshake.
+// We always advertise it, so it is enabled when the peer does.
+func (peerConnection *PeerConnection) SupportsFast() bool {
+	return peerConnection.Reserved[7]&0x04 != 0
+}
+
+// Computes the allowed fast set of a peer as described in BEP 6:
+// pieces a choked peer may still request, derived from its IPv4 address.
+func allowedFastSet(ip net.IP, infoHash []byte, piecesNum int, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || piecesNum == 0 {
+		return nil
+	}
+	if k > piecesNum {
+		k = piecesNum
+	}
+
+	// Only the /24 network of the peer is used
+	x := []byte{ip4[0], ip4[1], ip4[2], 0}
+	x = append(x, infoHash...)
+
+	set := []int{}
+	seen := make(map[int]bool)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(piecesNum))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// Sends a message whose payload is a piece index
+func (peerConnection *PeerConnection) sendPieceIndex(messageType MessageType, pieceIndex int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+	_, err := peerConnection.sendMessage(messageType, payload)
+	return err
+}
+
+// Tells the peer that one of its requests will not be answered
+func (peerConnection *PeerConnection) sendReject(request blockRequest) error {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(request.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(request.begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(request.length))
+	_, err := peerConnection.sendMessage(Reject, payload)
+	return err
+}
+
+// Sends the pieces we have, with Have All or Have None when the peer supports them
+func (peerConnection *PeerConnection) sendHaves(have Bitmap, piecesNum int) error {
+	messageType := Bitfield
+	var payload []byte = have
+	if peerConnection.SupportsFast() {
+		switch have.Count() {
+		case piecesNum:
+			messageType, payload = HaveAll, nil
+		case 0:
+			messageType, payload = HaveNone, nil
+		}
+	}
+	_, err := peerConnection.sendMessage(messageType, payload)
+	return err
+}
+
+// Checks if the peer lets us request a piece while it chokes us
+func (peerConnection *PeerConnection) IsAllowedFast(pieceIndex int) bool {
+	return peerConnection.AllowedFast[pieceIndex]
+}
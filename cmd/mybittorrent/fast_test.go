@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example of BEP 6
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	tests := []struct {
+		ip        net.IP
+		piecesNum int
+		k         int
+		want      []int
+	}{
+		{ip, 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{ip, 1313, 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		// Only the /24 network counts
+		{net.ParseIP("80.4.4.1"), 1313, 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{ip, 0, 7, nil},
+		{net.ParseIP("2001:db8::1"), 1313, 7, nil},
+	}
+
+	for _, test := range tests {
+		got := allowedFastSet(test.ip, infoHash, test.piecesNum, test.k)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("allowedFastSet(%v, %d, %d) = %v, want %v", test.ip, test.piecesNum, test.k, got, test.want)
+		}
+	}
+
+	// With fewer pieces than asked for, every piece is in the set once
+	got := allowedFastSet(ip, infoHash, 3, AllowedFastSetSize)
+	if len(got) != 3 {
+		t.Errorf("allowedFastSet with 3 pieces = %v, want the 3 pieces", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Magnet represents a magnet link
+type Magnet struct {
+	InfoHash []byte
+	Name     string
+	Trackers []string
+}
+
+// Parses a magnet link of the form magnet:?xt=urn:btih:<hash>&dn=<name>&tr=<tracker>
+// The info hash can be hex or base32 encoded.
+func ParseMagnet(uri string) (*Magnet, error) {
+	parsedUrl, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if parsedUrl.Scheme != "magnet" {
+		return nil, fmt.Errorf("Not a magnet link: %s", uri)
+	}
+
+	query := parsedUrl.Query()
+	magnet := Magnet{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+	}
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := strings.TrimPrefix(xt, "urn:btih:")
+
+		switch len(hash) {
+		case 40:
+			magnet.InfoHash, err = hex.DecodeString(hash)
+		case 32:
+			magnet.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("Invalid info hash length %d", len(hash))
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if magnet.InfoHash == nil {
+		return nil, fmt.Errorf("Magnet link has no BitTorrent info hash")
+	}
+
+	return &magnet, nil
+}
+
+// Checks if a command line argument is a magnet link rather than a file path
+func isMagnet(arg string) bool {
+	return strings.HasPrefix(arg, "magnet:")
+}
+
+// Creates a TorrentFile instance from a torrent file path or a magnet link.
+// For magnet links the info dictionary is fetched from the peers.
+func LoadTorrent(arg string) *TorrentFile {
+	if !isMagnet(arg) {
+		return ParseFile(arg)
+	}
+
+	magnet, err := ParseMagnet(arg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	torrent, err := ResolveMagnet(magnet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	torrent.Path = arg
+	return torrent
+}
+
+// Builds a torrent from a magnet link, fetching the info dictionary from peers
+func ResolveMagnet(magnet *Magnet) (*TorrentFile, error) {
+	torrent := magnetTorrent(magnet)
+
+	peers, err := findPeers(torrent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = FetchMetadata(torrent, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return torrent, nil
+}
+
+// Builds a torrent with the info hash and trackers of a magnet link, without its metadata
+func magnetTorrent(magnet *Magnet) *TorrentFile {
+	// Every tracker of the magnet link is a tier of its own so that all of them are used
+	torrent := TorrentFile{
+		InfoHash: magnet.InfoHash,
+		Info:     Info{Name: magnet.Name},
+	}
+	if len(magnet.Trackers) > 0 {
+		torrent.Announce = magnet.Trackers[0]
+	}
+	for _, tracker := range magnet.Trackers {
+		torrent.AnnounceList = append(torrent.AnnounceList, []string{tracker})
+	}
+	return &torrent
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
+// stringList is a command line flag that can be repeated
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 func main() {
 
 	// Read command
@@ -20,14 +34,15 @@ func main() {
 		// Example: ./your_bittorrent.sh info sample.torrent
 		torrentFile := os.Args[2]
 
-		torrent := ParseFile(torrentFile)
+		torrent := LoadTorrent(torrentFile)
 
 		PrintFileInfo(torrent)
 	} else if command == "peers" {
 		// Example: ./your_bittorrent.sh peers sample.torrent
+		// The trackers are announced to, then sent the stopped event once the peers are listed.
 		torrentFile := os.Args[2]
 
-		torrent := ParseFile(torrentFile)
+		torrent := LoadTorrent(torrentFile)
 
 		PrintPeers(torrent)
 	} else if command == "handshake" {
@@ -62,17 +77,135 @@ func main() {
 		DownloadPiece(destFile, torrent, pieceIndex)
 
 	} else if command == "download" {
-		// Example: ./your_bittorrent.sh download_piece -o /tmp/test-piece-0 sample.torrent 0
-		destFile := os.Args[3]
-		torrentFile := os.Args[4]
+		// Example: ./your_bittorrent.sh download -o /tmp/test.txt -backlog 10 sample.torrent
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		destFile := flags.String("o", "", "output path")
+		encryption := flags.String("encryption", "prefer", "peer encryption: prefer, require or disable")
+		transport := flags.String("transport", "prefer-tcp", "peer transport: prefer-tcp, prefer-utp, tcp or utp")
+		backlog := flags.Int("backlog", DefaultBacklog, "outstanding block requests per peer")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 || *destFile == "" || *backlog < 1 {
+			fmt.Println("Usage: download -o <path> [options] <torrent or magnet link>")
+			flags.PrintDefaults()
+			os.Exit(1)
+		}
+		setEncryptionPolicy(*encryption)
+		setTransportPolicy(*transport)
 
-		// 	Read the torrent file to get the tracker URL
-		torrent := ParseFile(torrentFile)
+		// 	Read the torrent file or magnet link to get the tracker URL
+		torrent := LoadTorrent(flags.Arg(0))
 
 		// Download the file
-		Download(destFile, torrent)
+		Download(*destFile, torrent, *backlog)
+	} else if command == "verify" {
+		// Example: ./your_bittorrent.sh verify sample.torrent /tmp/sample.txt
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: verify <torrent> <path>")
+			fmt.Println("  path is the file of a single-file torrent, or the directory holding")
+			fmt.Println("  the torrent directory of a multi-file torrent, as given to download and seed")
+			os.Exit(VerifyError)
+		}
+		torrentFile := os.Args[2]
+		contentPath := os.Args[3]
+
+		torrent := ParseFile(torrentFile)
+
+		// Check the content against the piece hashes
+		os.Exit(Verify(torrent, contentPath))
+	} else if command == "seed" {
+		// Example: ./your_bittorrent.sh seed -slots 4 sample.torrent /tmp/sample.txt
+		flags := flag.NewFlagSet("seed", flag.ExitOnError)
+		uploadSlots := flags.Int("slots", DefaultUploadSlots, "number of peers unchoked for their transfer rate")
+		encryption := flags.String("encryption", "prefer", "peer encryption: prefer, require or disable")
+		transport := flags.String("transport", "prefer-tcp", "peer transport: prefer-tcp, prefer-utp, tcp or utp")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 2 || *uploadSlots < 0 {
+			fmt.Println("Usage: seed [options] <torrent> <path>")
+			flags.PrintDefaults()
+			os.Exit(1)
+		}
+		setEncryptionPolicy(*encryption)
+		setTransportPolicy(*transport)
+
+		torrent := ParseFile(flags.Arg(0))
+
+		// Serve the content until interrupted
+		Seed(torrent, flags.Arg(1), *uploadSlots)
+	} else if command == "scrape" {
+		// Example: ./your_bittorrent.sh scrape sample.torrent other.torrent
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: scrape <torrent or magnet link>...")
+			os.Exit(1)
+		}
+
+		torrents := []*TorrentFile{}
+		for _, arg := range os.Args[2:] {
+			torrent, err := loadScrapeTorrent(arg)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			torrents = append(torrents, torrent)
+		}
+
+		// Print the swarm of every torrent as seen by its trackers
+		Scrape(torrents)
+	} else if command == "create" {
+		// Example: ./your_bittorrent.sh create -o sample.torrent -a http://tracker/announce sample.txt
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		destFile := flags.String("o", "", "torrent file to write (default: <name>.torrent)")
+		pieceLen := flags.Int("l", 0, "piece length in bytes (default: automatic)")
+		comment := flags.String("c", "", "comment")
+		createdBy := flags.String("b", "mybittorrent", "created by")
+		private := flags.Bool("p", false, "private torrent")
+		var announce, webSeeds stringList
+		flags.Var(&announce, "a", "announce URL, comma separated URLs form a tier (repeatable)")
+		flags.Var(&webSeeds, "w", "web seed URL (repeatable)")
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() != 1 {
+			fmt.Println("Usage: create [options] <file or directory>")
+			flags.PrintDefaults()
+			os.Exit(1)
+		}
+
+		options := CreateOptions{
+			Comment:   *comment,
+			CreatedBy: *createdBy,
+			PieceLen:  *pieceLen,
+			Private:   *private,
+			WebSeeds:  webSeeds,
+		}
+		for _, tier := range announce {
+			options.Announce = append(options.Announce, strings.Split(tier, ","))
+		}
+
+		// Hash the content and write the torrent
+		WriteTorrentFile(*destFile, flags.Arg(0), options)
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
 	}
 }
+
+// Sets the encryption policy of peer connections from a command line value
+func setEncryptionPolicy(value string) {
+	policy, err := ParseEncryptionPolicy(value)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	encryptionPolicy = policy
+}
+
+// Sets the transport of outgoing peer connections from a command line value
+func setTransportPolicy(value string) {
+	policy, err := ParseTransportPolicy(value)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	transportPolicy = policy
+}
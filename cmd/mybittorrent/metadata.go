@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const (
+	// Size of a piece of metadata exchanged with ut_metadata (BEP 9)
+	MetadataPieceSize = 16 * 1024
+
+	// Largest metadata we accept from a peer
+	MaxMetadataSize = 16 * 1024 * 1024
+
+	// Time allowed to fetch the metadata from a single peer
+	MetadataTimeout = 30 * time.Second
+)
+
+// ut_metadata message types
+const (
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+// Fetches the info dictionary of a torrent from the peers, trying them in turn.
+// The metadata is checked against the info hash before it is used.
+func FetchMetadata(torrent *TorrentFile, peers []Peer) error {
+	for i := range peers {
+		peer := &peers[i]
+
+		metadata, err := fetchMetadataFromPeer(torrent.InfoHash, peer)
+		if err != nil {
+			fmt.Printf("Metadata from %s: %v\n", peer, err)
+			continue
+		}
+
+		decoded, _, err := decodeBencode(string(metadata))
+		if err != nil {
+			return err
+		}
+		infoDecoded, ok := decoded.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Metadata is not a dictionary")
+		}
+		info, err := parseInfo(infoDecoded)
+		if err != nil {
+			return err
+		}
+
+		torrent.Info = *info
+		torrent.Metadata = metadata
+		return nil
+	}
+
+	return fmt.Errorf("No peer sent the metadata")
+}
+
+// Fetches the metadata from a single peer with the ut_metadata extension
+func fetchMetadataFromPeer(infoHash []byte, peer *Peer) ([]byte, error) {
+	peerConnection, err := peer.Handshake(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer peerConnection.Conn.Close()
+
+	if !peerConnection.SupportsExtensions() {
+		return nil, fmt.Errorf("Peer does not support extensions")
+	}
+	peerConnection.Conn.SetDeadline(time.Now().Add(MetadataTimeout))
+
+	err = peerConnection.sendExtendedHandshake(0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the extended handshake of the peer
+	for peerConnection.Extensions == nil {
+		messageType, payload, err := peerConnection.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		err = peerConnection.handleMessage(messageType, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !peerConnection.HasExtension("ut_metadata") {
+		return nil, fmt.Errorf("Peer does not support ut_metadata")
+	}
+	metadataSize := peerConnection.MetadataSize
+	if metadataSize <= 0 || metadataSize > MaxMetadataSize {
+		return nil, fmt.Errorf("Invalid metadata size %d", metadataSize)
+	}
+
+	// Collect the pieces in whatever order they arrive
+	piecesNum := (metadataSize + MetadataPieceSize - 1) / MetadataPieceSize
+	metadata := make([]byte, metadataSize)
+	received := make(map[int]bool)
+	peerConnection.HandleExtension("ut_metadata", func(peerConnection *PeerConnection, payload []byte) error {
+		dict, data, err := parseExtendedPayload(payload)
+		if err != nil {
+			return err
+		}
+		msgType, _ := dict["msg_type"].(int)
+		piece, _ := dict["piece"].(int)
+
+		switch msgType {
+		case MetadataReject:
+			return fmt.Errorf("Peer rejected metadata piece %d", piece)
+		case MetadataData:
+			if piece < 0 || piece >= piecesNum {
+				return fmt.Errorf("Metadata piece %d out of range", piece)
+			}
+			expected := MetadataPieceSize
+			if piece == piecesNum-1 {
+				expected = metadataSize - piece*MetadataPieceSize
+			}
+			if len(data) != expected {
+				return fmt.Errorf("Metadata piece %d has length %d, expected %d", piece, len(data), expected)
+			}
+			copy(metadata[piece*MetadataPieceSize:], data)
+			received[piece] = true
+		}
+		return nil
+	})
+
+	// Request all the pieces of the metadata at once
+	for i := 0; i < piecesNum; i++ {
+		err = peerConnection.SendExtension("ut_metadata", map[string]interface{}{
+			"msg_type": MetadataRequest,
+			"piece":    i,
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for len(received) < piecesNum {
+		messageType, payload, err := peerConnection.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		err = peerConnection.handleMessage(messageType, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The metadata must hash to the info hash of the magnet link
+	if !bytes.Equal(hashInfo(metadata), infoHash) {
+		return nil, fmt.Errorf("Metadata does not match the info hash")
+	}
+
+	return metadata, nil
+}
+
+// Returns a handler answering the ut_metadata requests of a peer with our metadata
+func serveMetadata(metadata []byte) ExtensionHandler {
+	piecesNum := (len(metadata) + MetadataPieceSize - 1) / MetadataPieceSize
+
+	return func(peerConnection *PeerConnection, payload []byte) error {
+		dict, _, err := parseExtendedPayload(payload)
+		if err != nil {
+			return err
+		}
+		msgType, _ := dict["msg_type"].(int)
+		piece, ok := dict["piece"].(int)
+		if msgType != MetadataRequest {
+			return nil
+		}
+
+		if !ok || piece < 0 || piece >= piecesNum {
+			return peerConnection.SendExtension("ut_metadata", map[string]interface{}{
+				"msg_type": MetadataReject,
+				"piece":    piece,
+			}, nil)
+		}
+
+		end := (piece + 1) * MetadataPieceSize
+		if end > len(metadata) {
+			end = len(metadata)
+		}
+		return peerConnection.SendExtension("ut_metadata", map[string]interface{}{
+			"msg_type":   MetadataData,
+			"piece":      piece,
+			"total_size": len(metadata),
+		}, metadata[piece*MetadataPieceSize:end])
+	}
+}
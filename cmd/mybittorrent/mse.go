@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// EncryptionPolicy tells when Message Stream Encryption is used with peers
+type EncryptionPolicy int
+
+const (
+	// Encrypt when the peer supports it, fall back to plaintext otherwise
+	EncryptionPrefer EncryptionPolicy = iota
+
+	// Only accept encrypted connections
+	EncryptionRequire
+
+	// Only use the plaintext protocol
+	EncryptionDisable
+)
+
+// Policy used for all peer connections, set from the command line
+var encryptionPolicy = EncryptionPrefer
+
+// crypto_provide and crypto_select methods of MSE
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+const (
+	// Length of the Diffie-Hellman public keys
+	mseKeyLen = 96
+
+	// Largest random padding in the MSE handshake
+	mseMaxPad = 512
+
+	// Bytes of the RC4 key streams that are thrown away
+	mseDiscard = 1024
+)
+
+// Prime and generator of the Diffie-Hellman key exchange
+var (
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+)
+
+// Parses an encryption policy given on the command line
+func ParseEncryptionPolicy(value string) (EncryptionPolicy, error) {
+	switch value {
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	case "disable":
+		return EncryptionDisable, nil
+	}
+	return 0, fmt.Errorf("Unknown encryption policy %q, expected prefer, require or disable", value)
+}
+
+// cryptoConn is a peer connection after the MSE handshake.
+// Data is encrypted with RC4 when it was selected, and bytes read during the
+// handshake that belong to the stream are returned first.
+type cryptoConn struct {
+	net.Conn
+	encrypt  *rc4.Cipher
+	decrypt  *rc4.Cipher
+	buffered []byte
+}
+
+func (conn *cryptoConn) Read(b []byte) (int, error) {
+	if len(conn.buffered) > 0 {
+		n := copy(b, conn.buffered)
+		conn.buffered = conn.buffered[n:]
+		return n, nil
+	}
+
+	n, err := conn.Conn.Read(b)
+	if conn.decrypt != nil {
+		conn.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (conn *cryptoConn) Write(b []byte) (int, error) {
+	if conn.encrypt == nil {
+		return conn.Conn.Write(b)
+	}
+	encrypted := make([]byte, len(b))
+	conn.encrypt.XORKeyStream(encrypted, b)
+	return conn.Conn.Write(encrypted)
+}
+
+// Hashes the concatenation of the given values
+func mseHash(values ...[]byte) []byte {
+	hash := sha1.New()
+	for _, value := range values {
+		hash.Write(value)
+	}
+	return hash.Sum(nil)
+}
+
+// Creates an RC4 cipher keyed for one direction, with the start of the key stream discarded
+func mseCipher(name string, secret []byte, skey []byte) (*rc4.Cipher, error) {
+	cipher, err := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	if err != nil {
+		return nil, err
+	}
+	discard := make([]byte, mseDiscard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher, nil
+}
+
+// Generates a Diffie-Hellman key pair, the public key padded to 96 bytes
+func mseKeyPair() (*big.Int, []byte, error) {
+	privateBytes := make([]byte, 20)
+	_, err := rand.Read(privateBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(mseG, private, mseP)
+	return private, padKey(public), nil
+}
+
+// Computes the shared secret from our private key and the public key of the peer
+func mseSecret(private *big.Int, peerPublic []byte) []byte {
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(peerPublic), private, mseP)
+	return padKey(secret)
+}
+
+// Encodes a key as 96 big endian bytes
+func padKey(key *big.Int) []byte {
+	padded := make([]byte, mseKeyLen)
+	keyBytes := key.Bytes()
+	copy(padded[mseKeyLen-len(keyBytes):], keyBytes)
+	return padded
+}
+
+// Returns up to 512 random bytes of padding
+func randomPad() []byte {
+	pad := make([]byte, randomUint32()%(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+// Reads from the connection until the given pattern, which must appear
+// within the next limit bytes. The pattern itself is consumed.
+func readUntil(conn net.Conn, pattern []byte, limit int) error {
+	window := make([]byte, 0, len(pattern))
+	b := make([]byte, 1)
+	for read := 0; read < limit+len(pattern); read++ {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = window[1:]
+		}
+		window = append(window, b[0])
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("MSE synchronization pattern not found")
+}
+
+// Reads and decrypts a number of bytes of the handshake
+func readDecrypted(conn net.Conn, cipher *rc4.Cipher, length int) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := io.ReadFull(conn, data)
+	if err != nil {
+		return nil, err
+	}
+	cipher.XORKeyStream(data, data)
+	return data, nil
+}
+
+// Runs the MSE handshake on an outgoing connection for a torrent.
+// provide holds the crypto methods we accept, the peer selects one of them.
+func mseInitiate(conn net.Conn, infoHash []byte, provide uint32) (net.Conn, error) {
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. A->B: Diffie Hellman Ya, PadA
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Diffie Hellman Yb, PadB
+	peerPublic := make([]byte, mseKeyLen)
+	_, err = io.ReadFull(conn, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret := mseSecret(private, peerPublic)
+
+	encrypt, err := mseCipher("keyA", secret, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	decrypt, err := mseCipher("keyB", secret, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	message := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash)
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		message = append(message, req2[i]^req3[i])
+	}
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+	_, err = conn.Write(append(message, encrypted...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD).
+	// The encrypted VC tells where PadB ends.
+	vc := make([]byte, 8)
+	decrypt.XORKeyStream(vc, vc)
+	err = readUntil(conn, vc, mseMaxPad)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readDecrypted(conn, decrypt, 4+2)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(reply[0:4])
+	padLen := int(binary.BigEndian.Uint16(reply[4:6]))
+	if padLen > mseMaxPad {
+		return nil, fmt.Errorf("Invalid MSE padding length %d", padLen)
+	}
+	_, err = readDecrypted(conn, decrypt, padLen)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &cryptoConn{Conn: conn, encrypt: encrypt, decrypt: decrypt}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &cryptoConn{Conn: conn}, nil
+	}
+	return nil, fmt.Errorf("Peer selected the unsupported crypto method %d", selected)
+}
+
+// Runs the MSE handshake on an incoming connection whose first bytes were
+// already read. Finds the torrent among infoHashes from the SKEY of the peer
+// and returns the connection with the info hash of that torrent.
+func mseAccept(conn net.Conn, start []byte, infoHashes [][]byte) (net.Conn, []byte, error) {
+	// 1. A->B: Diffie Hellman Ya, PadA
+	peerPublic := make([]byte, mseKeyLen)
+	copy(peerPublic, start)
+	_, err := io.ReadFull(conn, peerPublic[len(start):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2. B->A: Diffie Hellman Yb, PadB
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := mseSecret(private, peerPublic)
+
+	// 3. A->B: HASH('req1', S) follows PadA, then the obfuscated SKEY
+	err = readUntil(conn, mseHash([]byte("req1"), secret), mseMaxPad)
+	if err != nil {
+		return nil, nil, err
+	}
+	obfuscated := make([]byte, 20)
+	_, err = io.ReadFull(conn, obfuscated)
+	if err != nil {
+		return nil, nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		req2 := mseHash([]byte("req2"), candidate)
+		match := true
+		for i := range req2 {
+			if req2[i]^req3[i] != obfuscated[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, fmt.Errorf("Encrypted connection for an unknown torrent")
+	}
+
+	decrypt, err := mseCipher("keyA", secret, infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypt, err := mseCipher("keyB", secret, infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := readDecrypted(conn, decrypt, 8+4+2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(request[0:8], make([]byte, 8)) {
+		return nil, nil, fmt.Errorf("Invalid MSE verification constant")
+	}
+	provide := binary.BigEndian.Uint32(request[8:12])
+	padLen := int(binary.BigEndian.Uint16(request[12:14]))
+	if padLen > mseMaxPad {
+		return nil, nil, fmt.Errorf("Invalid MSE padding length %d", padLen)
+	}
+	_, err = readDecrypted(conn, decrypt, padLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	iaLen, err := readDecrypted(conn, decrypt, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	initialPayload, err := readDecrypted(conn, decrypt, int(binary.BigEndian.Uint16(iaLen)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Select RC4 unless the policy allows plaintext and the peer only provides it
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && encryptionPolicy != EncryptionRequire:
+		selected = cryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("No acceptable crypto method in %d", provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &cryptoConn{Conn: conn, buffered: initialPayload}, infoHash, nil
+	}
+	return &cryptoConn{Conn: conn, encrypt: encrypt, decrypt: decrypt, buffered: initialPayload}, infoHash, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mseResult is the outcome of one side of a handshake
+type mseResult struct {
+	conn     net.Conn
+	infoHash []byte
+	err      error
+}
+
+// Runs an MSE handshake between two ends of a loopback TCP connection
+func mseLoopback(t *testing.T, infoHash []byte, provide uint32, served [][]byte) (mseResult, mseResult) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan mseResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- mseResult{err: err}
+			return
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		start := make([]byte, 20)
+		_, err = io.ReadFull(conn, start)
+		if err != nil {
+			conn.Close()
+			accepted <- mseResult{err: err}
+			return
+		}
+		stream, infoHash, err := mseAccept(conn, start, served)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- mseResult{conn: stream, infoHash: infoHash, err: err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	stream, err := mseInitiate(conn, infoHash, provide)
+	if err != nil {
+		conn.Close()
+	}
+	initiated := mseResult{conn: stream, infoHash: infoHash, err: err}
+
+	result := <-accepted
+	t.Cleanup(func() {
+		if initiated.conn != nil {
+			initiated.conn.Close()
+		}
+		if result.conn != nil {
+			result.conn.Close()
+		}
+	})
+	return initiated, result
+}
+
+// Checks that data written on each end arrives intact on the other
+func checkExchange(t *testing.T, a net.Conn, b net.Conn) {
+	for _, pair := range [][2]net.Conn{{a, b}, {b, a}} {
+		message := []byte("\x13BitTorrent protocol" + strings.Repeat("x", 3000))
+		go pair[0].Write(message)
+		received := make([]byte, len(message))
+		_, err := io.ReadFull(pair[1], received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, message) {
+			t.Errorf("received %q..., want %q...", received[:20], message[:20])
+		}
+	}
+}
+
+func TestMSEHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	other := bytes.Repeat([]byte{0xbb}, 20)
+
+	tests := []struct {
+		name      string
+		provide   uint32
+		policy    EncryptionPolicy
+		encrypted bool
+	}{
+		{"rc4", cryptoRC4, EncryptionPrefer, true},
+		{"both prefer rc4", cryptoRC4 | cryptoPlaintext, EncryptionPrefer, true},
+		{"plaintext", cryptoPlaintext, EncryptionPrefer, false},
+		{"rc4 when required", cryptoRC4 | cryptoPlaintext, EncryptionRequire, true},
+	}
+
+	defer func(policy EncryptionPolicy) { encryptionPolicy = policy }(encryptionPolicy)
+	for _, test := range tests {
+		encryptionPolicy = test.policy
+		initiated, accepted := mseLoopback(t, infoHash, test.provide, [][]byte{other, infoHash})
+		if initiated.err != nil || accepted.err != nil {
+			t.Errorf("%s: handshake failed: %v, %v", test.name, initiated.err, accepted.err)
+			continue
+		}
+		if !bytes.Equal(accepted.infoHash, infoHash) {
+			t.Errorf("%s: accepted for %x, want %x", test.name, accepted.infoHash, infoHash)
+		}
+		for _, conn := range []net.Conn{initiated.conn, accepted.conn} {
+			if encrypted := conn.(*cryptoConn).encrypt != nil; encrypted != test.encrypted {
+				t.Errorf("%s: encrypted = %v, want %v", test.name, encrypted, test.encrypted)
+			}
+		}
+		checkExchange(t, initiated.conn, accepted.conn)
+	}
+}
+
+func TestMSEHandshakeRefused(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	other := bytes.Repeat([]byte{0xbb}, 20)
+
+	defer func(policy EncryptionPolicy) { encryptionPolicy = policy }(encryptionPolicy)
+
+	// The torrent is not served
+	encryptionPolicy = EncryptionPrefer
+	_, accepted := mseLoopback(t, infoHash, cryptoRC4, [][]byte{other})
+	if accepted.err == nil {
+		t.Errorf("handshake for an unknown torrent succeeded")
+	}
+
+	// Plaintext is all the peer provides, and we require encryption
+	encryptionPolicy = EncryptionRequire
+	_, accepted = mseLoopback(t, infoHash, cryptoPlaintext, [][]byte{infoHash})
+	if accepted.err == nil {
+		t.Errorf("plaintext handshake succeeded with encryption required")
+	}
+}
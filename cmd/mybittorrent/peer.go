@@ -1,34 +1,94 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"os"
-	"strconv"
-	"strings"
+	"net/netip"
+	"sync"
+	"time"
 )
 
-// Peer represents a peer in the bittorrent network
+// Peer represents a peer in the bittorrent network, reachable over IPv4 or IPv6
 type Peer struct {
-	Ip   string
-	Port int
+	Addr netip.AddrPort
 }
 
 // PeerConnection represents a peer that is connected to the local client
 type PeerConnection struct {
-	PeerId string
-	Peer   *Peer
-	Conn   *net.TCPConn
+	PeerId    string
+	Peer      *Peer
+	Conn      net.Conn
+	Bitfield  Bitmap // pieces the peer has
+	PiecesNum int    // number of pieces of the torrent, 0 while unknown
+	Reserved  [8]byte
+	writeMu   sync.Mutex // messages may be sent from several goroutines
+
+	// Extension protocol state, set by the extended handshake of the peer
+	Extensions        map[string]int // extension name to the message id the peer assigned
+	MetadataSize      int
+	Client            string // client name and version
+	ListenPort        int    // port the peer accepts connections on
+	MaxRequests       int    // outstanding requests the peer accepts
+	YourIp            net.IP // our address as seen by the peer
+	extensionHandlers map[string]ExtensionHandler
+
+	// Choking state, connections start choked and not interested
+	stateMu        sync.Mutex
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+
+	// Fast Extension state
+	AllowedFast map[int]bool // pieces we may request while the peer chokes us
+	Suggested   []int        // pieces the peer suggested we download
+
+	DHTPort   int       // DHT port sent by the peer in a Port message
+	received  int       // number of messages received, keep-alives and extended messages excluded
+	lastWrite time.Time // when we last sent something, for keep-alives
+
+	Stats PeerStats
+}
+
+// PeerStats counts the data exchanged with a peer
+type PeerStats struct {
+	mu          sync.Mutex
+	Downloaded  int64
+	Uploaded    int64
+	LastBlockAt time.Time // when the peer last sent us a block
 }
 
 const (
 	BlockSize int64 = 16 * 1024 // 16kb
+
+	// Number of corrupt pieces a peer may send before it is banned
+	MaxHashFailures = 3
+
+	// Default number of outstanding block requests per connection
+	DefaultBacklog = 5
+
+	// Time allowed to connect to a peer
+	DialTimeout = 5 * time.Second
+
+	// Largest message accepted from a peer
+	MaxMessageLength = 1024 * 1024
+
+	// A keep-alive is sent when nothing else was sent for this long
+	KeepAliveInterval = 2 * time.Minute
 )
 
+// BanList keeps track of peers that sent pieces failing the hash check.
+// Peers that fail too many times are banned for the rest of the session.
+type BanList struct {
+	mu       sync.Mutex
+	failures map[string]int
+	banned   map[string]bool
+}
+
 type MessageType int // Bittorrent available message types
 const (
 	Choke MessageType = iota
@@ -40,127 +100,258 @@ const (
 	Request
 	Piece
 	Cancel
+	Port
 )
 
-// Given a torrent file, we collect the Announce URL together with the InfoHash
-// and we enable the client to request peers from the tracker server.
-func RequestPeers(torrent *TorrentFile) ([]Peer, error) {
+// Returned by readMessage for the zero length keep-alive message
+const KeepAlive MessageType = -1
 
-	// Get the local peer ID
-	localPeerId, err := getLocalId()
-
-	// Do HTTP GET request to the tracker
-	req, err := http.NewRequest("GET", torrent.Announce, nil)
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
+// Creates a peer connection over an established connection
+func newPeerConnection(peer *Peer, conn net.Conn, peerId []byte, reserved [8]byte) *PeerConnection {
+	peerConnection := PeerConnection{
+		PeerId:      hex.EncodeToString(peerId),
+		Peer:        peer,
+		Conn:        conn,
+		Reserved:    reserved,
+		AmChoking:   true,
+		PeerChoking: true,
+		lastWrite:   time.Now(),
 	}
+	peerConnection.Stats.LastBlockAt = time.Now()
+	return &peerConnection
+}
 
-	// Add the query parameters
-	q := req.URL.Query()
-	q.Add("info_hash", string(torrent.InfoHash))
-	q.Add("peer_id", localPeerId)
-	q.Add("port", "6881")
-	q.Add("uploaded", "0")
-	q.Add("downloaded", "0")
-	q.Add("left", fmt.Sprint(torrent.Info.Length))
-	q.Add("compact", "1")
-	req.URL.RawQuery = q.Encode()
+// Records a block received from the peer
+func (stats *PeerStats) AddDownloaded(length int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.Downloaded += int64(length)
+	stats.LastBlockAt = time.Now()
+}
 
-	// Do the request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// Records a block sent to the peer
+func (stats *PeerStats) AddUploaded(length int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.Uploaded += int64(length)
+}
 
-	// Read the response
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// Returns the bytes downloaded from and uploaded to the peer and when it last sent a block
+func (stats *PeerStats) Snapshot() (int64, int64, time.Time) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.Downloaded, stats.Uploaded, stats.LastBlockAt
+}
+
+// Creates a peer from an IP address and a port.
+// IPv4 addresses mapped in IPv6 are stored as IPv4 so that every peer has a single form.
+func newPeer(ip net.IP, port int) Peer {
+	addr, _ := netip.AddrFromSlice(ip)
+	return Peer{Addr: netip.AddrPortFrom(addr.Unmap(), uint16(port))}
+}
+
+// Returns the peer address as ip:port, with IPv6 addresses in brackets
+func (peer *Peer) String() string {
+	return peer.Addr.String()
+}
+
+// Returns the IP address of the peer
+func (peer *Peer) IP() net.IP {
+	return net.IP(peer.Addr.Addr().AsSlice())
+}
+
+// Creates an empty ban list
+func NewBanList() *BanList {
+	return &BanList{
+		failures: make(map[string]int),
+		banned:   make(map[string]bool),
 	}
+}
 
-	// Decode the response
-	decoded, _, err := decodeBencode(string(responseBody))
+// Records a hash failure for a peer.
+// Returns true if the peer has now been banned.
+func (banList *BanList) RecordHashFailure(peer *Peer) bool {
+	banList.mu.Lock()
+	defer banList.mu.Unlock()
 
-	// Get the peers from the decoded string
-	responsePeers := decoded.(map[string]interface{})["peers"].(string)
-	peers := make([]Peer, len(responsePeers)/6)
-	for i := 0; i < len(responsePeers); i += 6 {
-		peers[i/6].Ip = fmt.Sprintf("%d.%d.%d.%d", responsePeers[i], responsePeers[i+1], responsePeers[i+2], responsePeers[i+3])
-		peers[i/6].Port = int(responsePeers[i+4])<<8 + int(responsePeers[i+5])
+	key := peer.String()
+	banList.failures[key]++
+	if banList.failures[key] >= MaxHashFailures {
+		banList.banned[key] = true
 	}
+	return banList.banned[key]
+}
 
-	return peers, nil
+// Checks if a peer has been banned
+func (banList *BanList) IsBanned(peer *Peer) bool {
+	banList.mu.Lock()
+	defer banList.mu.Unlock()
+	return banList.banned[peer.String()]
 }
 
 // Given a peer decoded string, we collect the peer IP and port.
+// IPv6 addresses are written in brackets, as in [::1]:6881, and host names are resolved.
 func ParsePeerFromStr(peerStr string) (*Peer, error) {
-	parts := strings.Split(peerStr, ":")
-	port, err := strconv.Atoi(parts[1])
+	addr, err := netip.ParseAddrPort(peerStr)
 	if err != nil {
-		return nil, err
+		tcpAddr, resolveErr := net.ResolveTCPAddr("tcp", peerStr)
+		if resolveErr != nil {
+			return nil, err
+		}
+		addr = tcpAddr.AddrPort()
 	}
-	peer := Peer{Ip: parts[0], Port: port}
+	peer := Peer{Addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
 	return &peer, nil
 }
 
-// Executes a handshake with a peer and returns the peer ID and the TCP connection.
+// Executes a handshake with a peer and returns the peer ID and the connection.
+// Depending on the encryption policy the connection is first set up with
+// Message Stream Encryption, falling back to plaintext when it is only preferred.
 func (peer *Peer) Handshake(infoHash []byte) (*PeerConnection, error) {
 
 	// Get the local peer ID
 	localPeerId, err := getLocalId()
+	if err != nil {
+		return nil, err
+	}
 
-	// Map the TCP address
-	tcpAddr, err := net.ResolveTCPAddr("tcp", peer.Ip+":"+strconv.Itoa(peer.Port))
+	conn, err := peer.dial()
 	if err != nil {
 		return nil, err
 	}
 
-	// Connect to the peer
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	// Negotiate the encryption, peers without MSE usually close the connection
+	if encryptionPolicy != EncryptionDisable {
+		provide := uint32(cryptoRC4 | cryptoPlaintext)
+		if encryptionPolicy == EncryptionRequire {
+			provide = cryptoRC4
+		}
+		encrypted, err := mseInitiate(conn, infoHash, provide)
+		if err != nil {
+			conn.Close()
+			if encryptionPolicy == EncryptionRequire {
+				return nil, fmt.Errorf("Encryption with %s failed: %v", peer, err)
+			}
+			conn, err = peer.dial()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			conn = encrypted
+		}
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	// Exchange the handshake messages
+	err = writeHandshake(conn, infoHash, localPeerId)
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reserved, replyInfoHash, replyPeerId, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	// Send the handshake message according to BitTorrent protocol
+	// Check the peer is serving the same torrent
+	if !bytes.Equal(replyInfoHash, infoHash) {
+		conn.Close()
+		return nil, fmt.Errorf("Peer %s replied with a different info hash", peer)
+	}
+
+	// Create a peer connection, returning the encoded peer ID and the connection
+	return newPeerConnection(peer, conn, replyPeerId, reserved), nil
+}
+
+// Opens a connection to the peer with the transports allowed by the policy,
+// with a deadline for the handshake
+func (peer *Peer) dial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch transportPolicy {
+	case TransportTCP:
+		conn, err = peer.dialTCP()
+	case TransportUTP:
+		conn, err = dialUTP(peer.String(), DialTimeout)
+	case TransportPreferUTP:
+		conn, err = dialUTP(peer.String(), DialTimeout)
+		if err != nil {
+			conn, err = peer.dialTCP()
+		}
+	default:
+		conn, err = peer.dialTCP()
+		if err != nil {
+			conn, err = dialUTP(peer.String(), DialTimeout)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	return conn, nil
+}
+
+// Opens a TCP connection to the peer
+func (peer *Peer) dialTCP() (net.Conn, error) {
+	dialer := net.Dialer{Timeout: DialTimeout}
+	return dialer.Dial("tcp", peer.String())
+}
+
+// Returns the peer at the other end of a TCP or uTP connection
+func remotePeer(conn net.Conn) *Peer {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		peer := newPeer(addr.IP, addr.Port)
+		return &peer
+	case *net.UDPAddr:
+		peer := newPeer(addr.IP, addr.Port)
+		return &peer
+	}
+	return &Peer{}
+}
+
+// Sends the handshake message according to BitTorrent protocol
+func writeHandshake(conn net.Conn, infoHash []byte, localPeerId string) error {
 	msg := []byte{}
 	msg = append(msg, 19)
 	msg = append(msg, []byte("BitTorrent protocol")...)
-	msg = append(msg, make([]byte, 8)...)
+	msg = append(msg, reservedBytes()...)
 	msg = append(msg, infoHash...)
 	msg = append(msg, []byte(localPeerId)...)
-	_, err = conn.Write(msg)
-	if err != nil {
-		return nil, err
-	}
+	_, err := conn.Write(msg)
+	return err
+}
 
-	// Read the handshake response according to BitTorrent protocol
-	// (1 byte + 19 bytes + 8 bytes + 20 bytes + 20 bytes)
-	// 1 byte: length of the protocol string
-	// 19 bytes: protocol string
-	// 8 bytes: reserved bytes
-	// 20 bytes: info hash
-	// 20 bytes: peer ID
+// Reads the handshake of a peer according to BitTorrent protocol
+// (1 byte + 19 bytes + 8 bytes + 20 bytes + 20 bytes)
+// 1 byte: length of the protocol string
+// 19 bytes: protocol string
+// 8 bytes: reserved bytes
+// 20 bytes: info hash
+// 20 bytes: peer ID
+func readHandshake(conn net.Conn) (reserved [8]byte, infoHash []byte, peerId []byte, err error) {
 	reply := make([]byte, 1+19+8+20+20)
-	_, err = conn.Read(reply)
+	_, err = io.ReadFull(conn, reply)
 	if err != nil {
-		return nil, err
+		return reserved, nil, nil, err
 	}
-
-	// Get the peer ID
-	replyPeerId := reply[1+19+8+20:]
-	encodedPeerId := hex.EncodeToString(replyPeerId)
-
-	// Create a peer connection
-	peerConnection := PeerConnection{
-		PeerId: encodedPeerId,
-		Peer:   peer,
-		Conn:   conn,
+	if reply[0] != 19 || string(reply[1:20]) != "BitTorrent protocol" {
+		return reserved, nil, nil, fmt.Errorf("Invalid handshake protocol")
 	}
 
-	// Return the encoded peer ID and the TCP connection
-	return &peerConnection, nil
+	copy(reserved[:], reply[1+19:1+19+8])
+	infoHash = reply[1+19+8 : 1+19+8+20]
+	peerId = reply[1+19+8+20:]
+	return reserved, infoHash, peerId, nil
+}
+
+// Returns the reserved bytes of our handshake, advertising the extensions we support
+func reservedBytes() []byte {
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // extension protocol (BEP 10)
+	reserved[7] |= 0x04 // Fast Extension (BEP 6)
+	return reserved
 }
 
 // Sends a TCP message according to the protocol
@@ -181,114 +372,286 @@ func (peerConnection *PeerConnection) sendMessage(messageType MessageType, paylo
 	copy(message[5:], payload)
 
 	// Sends the message
+	peerConnection.writeMu.Lock()
+	defer peerConnection.writeMu.Unlock()
 	n, err := peerConnection.Conn.Write(message)
 	if err != nil {
 		return 0, err
 	}
+	peerConnection.lastWrite = time.Now()
 
 	return n, nil
 }
 
-// Reads a TCP message according to the protocol
-func (peerConnection *PeerConnection) readMessage() (MessageType, []byte) {
+// Sends keep-alives while the connection is otherwise quiet, until done is closed
+func (peerConnection *PeerConnection) keepAlive(done chan struct{}) {
+	ticker := time.NewTicker(KeepAliveInterval / 4)
+	defer ticker.Stop()
 
-	// First reads the message length
-	var messageLength uint32
-	binary.Read(peerConnection.Conn, binary.BigEndian, &messageLength)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
 
-	// Then reads the message type
-	var messageTypeByte byte
-	binary.Read(peerConnection.Conn, binary.BigEndian, &messageTypeByte)
-	messageType := MessageType(messageTypeByte)
+		peerConnection.writeMu.Lock()
+		if time.Since(peerConnection.lastWrite) >= KeepAliveInterval {
+			// A keep-alive is a message of zero length without a type
+			_, err := peerConnection.Conn.Write(make([]byte, 4))
+			if err != nil {
+				peerConnection.writeMu.Unlock()
+				return
+			}
+			peerConnection.lastWrite = time.Now()
+		}
+		peerConnection.writeMu.Unlock()
+	}
+}
 
-	// If there is a payload, reads it
-	if messageLength > 1 {
-		payload := make([]byte, messageLength-1)
-		io.ReadAtLeast(peerConnection.Conn, payload, len(payload))
-		return messageType, payload
+// Chokes or unchokes the peer, sending the message only when the state changes
+func (peerConnection *PeerConnection) setChoking(choking bool) error {
+	peerConnection.stateMu.Lock()
+	defer peerConnection.stateMu.Unlock()
+
+	if peerConnection.AmChoking == choking {
+		return nil
+	}
+	messageType := Unchoke
+	if choking {
+		messageType = Choke
+	}
+	_, err := peerConnection.sendMessage(messageType, nil)
+	if err != nil {
+		return err
 	}
+	peerConnection.AmChoking = choking
+	return nil
+}
 
-	// If there is no payload, returns nil
-	return messageType, nil
+// Stops uploading to the peer
+func (peerConnection *PeerConnection) Choke() error {
+	return peerConnection.setChoking(true)
 }
 
-// Request a piece from a peer given an index and the length of the piece.
-// Returns the piece data and an error if any.
-func (peerConnection *PeerConnection) RequestPiece(pieceLength int64, pieceIndex int, torrentLength int64) ([]byte, error) {
+// Allows the peer to request blocks from us
+func (peerConnection *PeerConnection) Unchoke() error {
+	return peerConnection.setChoking(false)
+}
+
+// Checks if we are choking the peer
+func (peerConnection *PeerConnection) IsChoking() bool {
+	peerConnection.stateMu.Lock()
+	defer peerConnection.stateMu.Unlock()
+	return peerConnection.AmChoking
+}
 
-	// Check if this the last piece of a torrent
-	if pieceIndex >= int(torrentLength/pieceLength) {
-		pieceLength = torrentLength - (pieceLength * int64(pieceIndex))
+// Tells the peer whether we want to download from it
+func (peerConnection *PeerConnection) SetInterested(interested bool) error {
+	peerConnection.stateMu.Lock()
+	defer peerConnection.stateMu.Unlock()
+
+	if peerConnection.AmInterested == interested {
+		return nil
+	}
+	messageType := NotInterested
+	if interested {
+		messageType = Interested
+	}
+	_, err := peerConnection.sendMessage(messageType, nil)
+	if err != nil {
+		return err
 	}
+	peerConnection.AmInterested = interested
+	return nil
+}
 
-	// Create a byte array to store the piece
-	data := make([]byte, pieceLength)
+// Returns whether the peer wants to download from us and whether we want to download from it
+func (peerConnection *PeerConnection) interest() (peerInterested bool, amInterested bool) {
+	peerConnection.stateMu.Lock()
+	defer peerConnection.stateMu.Unlock()
+	return peerConnection.PeerInterested, peerConnection.AmInterested
+}
 
-	// Check the size of the last Block Size
-	lastBlockSize := pieceLength % BlockSize
+// Reads a TCP message according to the protocol.
+// Keep-alives are returned as the KeepAlive message type.
+func (peerConnection *PeerConnection) readMessage() (MessageType, []byte, error) {
 
-	// Calculate the number of pieces
-	piecesNum := (pieceLength - lastBlockSize) / BlockSize
+	// First reads the message length
+	var messageLength uint32
+	err := binary.Read(peerConnection.Conn, binary.BigEndian, &messageLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	if messageLength == 0 {
+		return KeepAlive, nil, nil
+	}
+	if messageLength > MaxMessageLength {
+		return 0, nil, fmt.Errorf("Message of %d bytes from %s is too long", messageLength, peerConnection.Peer)
+	}
 
-	// If the last block size is greater than 0, we need to add one more piece
-	if lastBlockSize > 0 {
-		piecesNum++
+	// Then reads the message type and the payload
+	message := make([]byte, messageLength)
+	_, err = io.ReadFull(peerConnection.Conn, message)
+	if err != nil {
+		return 0, nil, err
 	}
+	messageType := MessageType(message[0])
 
-	// For each block, request the piece
-	for i := int64(0); i < pieceLength; i += int64(BlockSize) {
+	// If there is no payload, returns nil
+	if messageLength == 1 {
+		return messageType, nil, nil
+	}
+	return messageType, message[1:], nil
+}
 
-		length := BlockSize
+// Updates the connection state with a message received from the peer.
+// Request, Piece, Cancel and Reject are only checked here, their callers act on them.
+// Extended messages go to the handlers of their extension.
+// Unknown message types are ignored.
+func (peerConnection *PeerConnection) handleMessage(messageType MessageType, payload []byte) error {
+	if messageType == KeepAlive {
+		return nil
+	}
+	if messageType == Extended {
+		return peerConnection.handleExtended(payload)
+	}
+	first := peerConnection.received == 0
+	peerConnection.received++
 
-		if i+int64(BlockSize) > pieceLength {
-			fmt.Printf("reached last block, changing size to %d\n", lastBlockSize)
-			length = pieceLength - i
-			if length > BlockSize {
-				length = BlockSize
+	switch messageType {
+	case Choke, Unchoke, Interested, NotInterested:
+		if len(payload) != 0 {
+			return fmt.Errorf("Invalid message %d from %s", messageType, peerConnection.Peer)
+		}
+		peerConnection.stateMu.Lock()
+		switch messageType {
+		case Choke:
+			peerConnection.PeerChoking = true
+		case Unchoke:
+			peerConnection.PeerChoking = false
+		case Interested:
+			peerConnection.PeerInterested = true
+		case NotInterested:
+			peerConnection.PeerInterested = false
+		}
+		peerConnection.stateMu.Unlock()
+	case Have:
+		return peerConnection.handleHave(payload)
+	case Bitfield:
+		if !first {
+			return fmt.Errorf("Bitfield from %s is not the first message", peerConnection.Peer)
+		}
+		return peerConnection.handleBitfield(payload)
+	case HaveAll, HaveNone:
+		if !peerConnection.SupportsFast() || !first || len(payload) != 0 {
+			return fmt.Errorf("Unexpected message %d from %s", messageType, peerConnection.Peer)
+		}
+		if messageType == HaveAll {
+			for i := 0; i < peerConnection.PiecesNum; i++ {
+				peerConnection.Bitfield.Set(i)
 			}
 		}
-
-		// Create a piece request message
-		// Piece Index: 4 bytes
-		// Block Offset: 4 bytes
-		// Block Length: 4 bytes
-		requestMessage := make([]byte, 12)
-		binary.BigEndian.PutUint32(requestMessage[0:4], uint32(pieceIndex))
-		binary.BigEndian.PutUint32(requestMessage[4:8], uint32(i))
-		binary.BigEndian.PutUint32(requestMessage[8:], uint32(length))
-
-		// Send the request message
-		_, err := peerConnection.sendMessage(Request, requestMessage)
-		if err != nil {
-			return nil, err
+	case Request, Cancel, Reject:
+		if len(payload) != 12 || (messageType == Reject && !peerConnection.SupportsFast()) {
+			return fmt.Errorf("Invalid request message from %s", peerConnection.Peer)
+		}
+	case Suggest, AllowedFast:
+		if len(payload) != 4 || !peerConnection.SupportsFast() {
+			return fmt.Errorf("Invalid message %d from %s", messageType, peerConnection.Peer)
+		}
+		index := int(binary.BigEndian.Uint32(payload))
+		if !peerConnection.isValidPiece(index) {
+			return fmt.Errorf("Invalid piece index %d from %s", index, peerConnection.Peer)
+		}
+		if messageType == AllowedFast {
+			if peerConnection.AllowedFast == nil {
+				peerConnection.AllowedFast = make(map[int]bool)
+			}
+			peerConnection.AllowedFast[index] = true
+		} else if len(peerConnection.Suggested) < MaxSuggestedPieces {
+			peerConnection.Suggested = append(peerConnection.Suggested, index)
+		}
+	case Piece:
+		if len(payload) < 8 {
+			return fmt.Errorf("Invalid piece message from %s", peerConnection.Peer)
 		}
+	case Port:
+		if len(payload) != 2 {
+			return fmt.Errorf("Invalid port message from %s", peerConnection.Peer)
+		}
+		peerConnection.DHTPort = int(binary.BigEndian.Uint16(payload))
+	}
+	return nil
+}
 
-		// Read the response message
-		messageType, responseMsg := peerConnection.readMessage()
+// Handles a Have message by adding the piece to the peer bitfield
+func (peerConnection *PeerConnection) handleHave(payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("Invalid have message from %s", peerConnection.Peer)
+	}
+	index := int(binary.BigEndian.Uint32(payload))
+	if !peerConnection.isValidPiece(index) {
+		return fmt.Errorf("Invalid piece index %d from %s", index, peerConnection.Peer)
+	}
+	peerConnection.Bitfield.Set(index)
+	return nil
+}
 
-		// Check if the response is a piece message
-		if messageType != Piece {
-			fmt.Printf("Piece message not received! Received %v\n", messageType)
-			os.Exit(1)
-		}
+// Checks that a piece index sent by the peer is in the torrent.
+// Any index is accepted while the number of pieces is unknown.
+func (peerConnection *PeerConnection) isValidPiece(index int) bool {
+	return index >= 0 && (peerConnection.PiecesNum == 0 || index < peerConnection.PiecesNum)
+}
 
-		// If there is no response message, return the data read so far
-		if responseMsg == nil {
-			return data, nil
-		}
+// Handles a Bitfield message. When the number of pieces is known the
+// bitfield must have the same size as the one we prepared.
+func (peerConnection *PeerConnection) handleBitfield(payload []byte) error {
+	if peerConnection.Bitfield != nil && len(payload) != len(peerConnection.Bitfield) {
+		return fmt.Errorf("Invalid bitfield length %d from %s", len(payload), peerConnection.Peer)
+	}
 
-		// Copy payload to data given its offset
-		index := binary.BigEndian.Uint32(responseMsg[0:4])
-		if uint32(pieceIndex) != index {
-			return nil, fmt.Errorf("Expected piece index: %d, got=%d\n", pieceIndex, index)
+	// The spare bits after the last piece must be cleared
+	for i := peerConnection.PiecesNum; peerConnection.PiecesNum > 0 && i < len(payload)*8; i++ {
+		if Bitmap(payload).Has(i) {
+			return fmt.Errorf("Bitfield from %s has spare bits set", peerConnection.Peer)
 		}
-		begin := binary.BigEndian.Uint32(responseMsg[4:8])
-		block := responseMsg[8:]
-		copy(data[begin:], block)
-
 	}
+	peerConnection.Bitfield = Bitmap(payload)
+	return nil
+}
+
+// Checks if the peer is choking us
+func (peerConnection *PeerConnection) IsChoked() bool {
+	peerConnection.stateMu.Lock()
+	defer peerConnection.stateMu.Unlock()
+	return peerConnection.PeerChoking
+}
+
+// Sends a request message for a block of a piece
+func (peerConnection *PeerConnection) sendRequest(pieceIndex int, begin int64, length int64) error {
+	// Create a piece request message
+	// Piece Index: 4 bytes
+	// Block Offset: 4 bytes
+	// Block Length: 4 bytes
+	requestMessage := make([]byte, 12)
+	binary.BigEndian.PutUint32(requestMessage[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(requestMessage[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(requestMessage[8:], uint32(length))
+
+	_, err := peerConnection.sendMessage(Request, requestMessage)
+	return err
+}
+
+// Sends a cancel message for a block requested before
+func (peerConnection *PeerConnection) sendCancel(pieceIndex int, begin int64, length int64) error {
+	cancelMessage := make([]byte, 12)
+	binary.BigEndian.PutUint32(cancelMessage[0:4], uint32(pieceIndex))
+	binary.BigEndian.PutUint32(cancelMessage[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(cancelMessage[8:], uint32(length))
 
-	return data, nil
+	_, err := peerConnection.sendMessage(Cancel, cancelMessage)
+	return err
 }
 
 // Generates a Peer ID based on MAC address max 20 characters
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Returns a connection to a peer supporting the Fast Extension, for a torrent of the given number of pieces
+func fastPeerConnection(piecesNum int) *PeerConnection {
+	var reserved [8]byte
+	reserved[7] |= 0x04
+	peerConnection := newPeerConnection(&Peer{}, nil, make([]byte, 20), reserved)
+	peerConnection.Bitfield = NewBitmap(piecesNum)
+	peerConnection.PiecesNum = piecesNum
+	return peerConnection
+}
+
+// Returns the payload of a message carrying a piece index
+func pieceIndexPayload(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return payload
+}
+
+func TestHandleHaveAll(t *testing.T) {
+	peerConnection := fastPeerConnection(10)
+	err := peerConnection.handleMessage(HaveAll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := peerConnection.Bitfield.Count(); count != 10 {
+		t.Errorf("peer has %d pieces after HaveAll, want 10", count)
+	}
+	if peerConnection.Bitfield.Has(10) {
+		t.Errorf("HaveAll set a spare bit")
+	}
+}
+
+func TestHandleMessageInvalidPieceIndex(t *testing.T) {
+	tests := []struct {
+		messageType MessageType
+		payload     []byte
+		valid       bool
+	}{
+		{Have, pieceIndexPayload(9), true},
+		{Have, pieceIndexPayload(10), false},
+		{Suggest, pieceIndexPayload(0), true},
+		{Suggest, pieceIndexPayload(10), false},
+		{AllowedFast, pieceIndexPayload(9), true},
+		{AllowedFast, pieceIndexPayload(1 << 31), false},
+		{Bitfield, []byte{0xff, 0xc0}, true},
+		{Bitfield, []byte{0xff, 0xe0}, false},
+	}
+
+	for _, test := range tests {
+		peerConnection := fastPeerConnection(10)
+		err := peerConnection.handleMessage(test.messageType, test.payload)
+		if (err == nil) != test.valid {
+			t.Errorf("message %d %x: got error %v, want valid = %v", test.messageType, test.payload, err, test.valid)
+		}
+		if !test.valid && (len(peerConnection.AllowedFast) != 0 || len(peerConnection.Suggested) != 0 || peerConnection.Bitfield.Count() != 0) {
+			t.Errorf("message %d %x: invalid index was recorded", test.messageType, test.payload)
+		}
+	}
+}
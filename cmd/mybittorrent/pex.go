@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	// How often we send our peer list to a connection with ut_pex
+	PexInterval = time.Minute
+
+	// Most peers added or dropped in one ut_pex message (BEP 11)
+	MaxPexPeers = 50
+
+	// added.f flag of peers that accept incoming connections
+	PexReachable = 0x10
+)
+
+// Extended message id we assign to ut_pex, which is not used with private torrents
+var LocalPexId = registerExtension("ut_pex", false)
+
+// pexState remembers the peers last sent to a connection with ut_pex
+type pexState struct {
+	sent     map[string]Peer
+	lastSent time.Time
+}
+
+// Creates the ut_pex state of a connection, the first message is sent right away
+func newPexState() *pexState {
+	return &pexState{sent: make(map[string]Peer)}
+}
+
+// Checks if the next ut_pex message is due
+func (state *pexState) due() bool {
+	return time.Since(state.lastSent) >= PexInterval
+}
+
+// Sends the peers connected and disconnected since the last ut_pex message.
+// Nothing is sent when the peer list did not change.
+func (state *pexState) send(peerConnection *PeerConnection, connected map[string]Peer) error {
+	state.lastSent = time.Now()
+
+	added := []Peer{}
+	for key, peer := range connected {
+		if _, ok := state.sent[key]; !ok && len(added) < MaxPexPeers {
+			added = append(added, peer)
+		}
+	}
+	dropped := []Peer{}
+	for key, peer := range state.sent {
+		if _, ok := connected[key]; !ok && len(dropped) < MaxPexPeers {
+			dropped = append(dropped, peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	added4, added6 := encodeCompactPeers(added)
+	dropped4, dropped6 := encodeCompactPeers(dropped)
+
+	// We connected to all the peers we know, so all of them are reachable
+	flags4 := bytes.Repeat([]byte{PexReachable}, len(added4)/6)
+	flags6 := bytes.Repeat([]byte{PexReachable}, len(added6)/18)
+
+	err := peerConnection.SendExtension("ut_pex", map[string]interface{}{
+		"added":    added4,
+		"added.f":  string(flags4),
+		"added6":   added6,
+		"added6.f": string(flags6),
+		"dropped":  dropped4,
+		"dropped6": dropped6,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range added {
+		state.sent[peer.String()] = peer
+	}
+	for _, peer := range dropped {
+		delete(state.sent, peer.String())
+	}
+	return nil
+}
+
+// Parses the peers added in a ut_pex message, the dropped peers are ignored
+func parsePex(payload []byte) ([]Peer, error) {
+	dict, _, err := parseExtendedPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	added4, _ := dict["added"].(string)
+	added6, _ := dict["added6"].(string)
+	peers := parseCompactPeers([]byte(added4), net.IPv4len)
+	peers = append(peers, parseCompactPeers([]byte(added6), net.IPv6len)...)
+
+	// Peers that flood us with addresses only get their first ones used
+	if len(peers) > 2*MaxPexPeers {
+		peers = peers[:2*MaxPexPeers]
+	}
+	return peers, nil
+}
+
+// Encodes peers in the compact format, returning the IPv4 and the IPv6 peers
+func encodeCompactPeers(peers []Peer) (string, string) {
+	var ipv4, ipv6 bytes.Buffer
+	for _, peer := range peers {
+		addr := peer.Addr.Addr()
+		if addr.Is4() {
+			ipv4.Write(addr.AsSlice())
+			binary.Write(&ipv4, binary.BigEndian, peer.Addr.Port())
+		} else if addr.Is6() {
+			ipv6.Write(addr.AsSlice())
+			binary.Write(&ipv6, binary.BigEndian, peer.Addr.Port())
+		}
+	}
+	return ipv4.String(), ipv6.String()
+}
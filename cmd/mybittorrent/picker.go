@@ -0,0 +1,353 @@
+package main
+
+import (
+	"sync"
+)
+
+// Number of pieces picked at random before switching to rarest first,
+// so that we quickly have something to offer to other peers
+const RandomFirstPieces = 4
+
+// pickerBlock is a block of a piece being downloaded
+type pickerBlock struct {
+	done       bool
+	requesters map[*downloadPeer]bool
+}
+
+// pickerPiece is a piece being downloaded, with the blocks received so far
+type pickerPiece struct {
+	data         []byte
+	blocks       []pickerBlock
+	received     int
+	contributors map[*Peer]bool
+	owner        *downloadPeer // only peer allowed to send the blocks, if set
+}
+
+// PiecePicker chooses the blocks requested from every peer.
+// Partially downloaded pieces are finished first, then new pieces are
+// picked at random for the first few pieces and rarest first afterwards,
+// by the number of connected peers that have them. Once every missing
+// block has been requested, the endgame mode requests the remaining
+// blocks from several peers at once.
+type PiecePicker struct {
+	torrent *TorrentFile
+
+	mu           sync.Mutex
+	wanted       Bitmap
+	remaining    int
+	availability []int
+	partial      map[int]*pickerPiece
+	completed    int
+	failed       map[int]map[*Peer]bool
+	suspect      map[int]bool
+}
+
+// Creates a picker for the given pieces of a torrent
+func NewPiecePicker(torrent *TorrentFile, pieces []int) *PiecePicker {
+	picker := &PiecePicker{
+		torrent:      torrent,
+		wanted:       NewBitmap(torrent.NumPieces()),
+		availability: make([]int, torrent.NumPieces()),
+		partial:      make(map[int]*pickerPiece),
+		failed:       make(map[int]map[*Peer]bool),
+		suspect:      make(map[int]bool),
+	}
+	for _, index := range pieces {
+		if !picker.wanted.Has(index) {
+			picker.wanted.Set(index)
+			picker.remaining++
+		}
+	}
+	return picker
+}
+
+// Counts the pieces of a newly connected peer
+func (picker *PiecePicker) AddBitfield(bitfield Bitmap) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for index := range picker.availability {
+		if bitfield.Has(index) {
+			picker.availability[index]++
+		}
+	}
+}
+
+// Counts a piece announced by a peer in a Have message
+func (picker *PiecePicker) AddHave(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	if index >= 0 && index < len(picker.availability) {
+		picker.availability[index]++
+	}
+}
+
+// Forgets the pieces of a disconnected peer, the blocks it was asked for and its failures
+func (picker *PiecePicker) RemovePeer(peer *downloadPeer) {
+	pending := peer.takeAll()
+
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for index := range picker.availability {
+		if peer.conn.Bitfield.Has(index) {
+			picker.availability[index]--
+		}
+	}
+	for _, request := range pending {
+		picker.unrequest(peer, request)
+	}
+	for _, failed := range picker.failed {
+		delete(failed, peer.peer)
+	}
+
+	// Pieces only this peer could send are started again by another peer
+	for index, piece := range picker.partial {
+		if piece.owner == peer {
+			delete(picker.partial, index)
+		}
+	}
+}
+
+// Gives back blocks that a peer will not send, for example after a choke
+func (picker *PiecePicker) Unrequest(peer *downloadPeer, requests []blockRequest) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for _, request := range requests {
+		picker.unrequest(peer, request)
+	}
+}
+
+func (picker *PiecePicker) unrequest(peer *downloadPeer, request blockRequest) {
+	piece, ok := picker.partial[request.index]
+	if !ok {
+		return
+	}
+	delete(piece.blocks[request.begin/int(BlockSize)].requesters, peer)
+}
+
+// Checks if a peer can give us a piece we still want.
+// A peer choking us may only be asked for the pieces of its allowed fast set.
+func (picker *PiecePicker) canPick(peer *downloadPeer, index int, choked bool) bool {
+	if choked && !peer.conn.IsAllowedFast(index) {
+		return false
+	}
+	if !picker.wanted.Has(index) || !peer.conn.Bitfield.Has(index) {
+		return false
+	}
+
+	// A peer that sent the piece corrupt is only asked again when no other peer has it
+	failed := picker.failed[index]
+	return !failed[peer.peer] || picker.availability[index] <= len(failed)
+}
+
+// Chooses the next block to request from a peer.
+// Returns false when the peer has nothing we need at the moment.
+func (picker *PiecePicker) Pick(peer *downloadPeer) (blockRequest, bool) {
+	choked := peer.conn.IsChoked()
+
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	// Partially downloaded pieces have strict priority
+	for index, piece := range picker.partial {
+		if !picker.canPick(peer, index, choked) || (piece.owner != nil && piece.owner != peer) {
+			continue
+		}
+		for i := range piece.blocks {
+			if !piece.blocks[i].done && len(piece.blocks[i].requesters) == 0 {
+				return picker.request(peer, index, i), true
+			}
+		}
+	}
+
+	// Start a new piece
+	index, ok := picker.pickPiece(peer, choked)
+	if ok {
+		picker.startPiece(peer, index)
+		return picker.request(peer, index, 0), true
+	}
+
+	// Endgame: every block is requested, ask for the ones still missing again
+	if len(picker.partial) < picker.remaining {
+		return blockRequest{}, false
+	}
+	bestIndex, bestBlock := -1, -1
+	for index, piece := range picker.partial {
+		if !picker.canPick(peer, index, choked) || piece.owner != nil {
+			continue
+		}
+		for i, block := range piece.blocks {
+			if block.done || block.requesters[peer] {
+				continue
+			}
+			if bestIndex == -1 || len(block.requesters) < len(picker.partial[bestIndex].blocks[bestBlock].requesters) {
+				bestIndex, bestBlock = index, i
+			}
+		}
+	}
+	if bestIndex == -1 {
+		return blockRequest{}, false
+	}
+	return picker.request(peer, bestIndex, bestBlock), true
+}
+
+// Chooses a piece to start: one suggested by the peer, or random for the
+// first pieces and the rarest afterwards
+func (picker *PiecePicker) pickPiece(peer *downloadPeer, choked bool) (int, bool) {
+	for _, index := range peer.conn.Suggested {
+		if _, ok := picker.partial[index]; !ok && picker.canPick(peer, index, choked) {
+			return index, true
+		}
+	}
+
+	candidates := []int{}
+	rarest := 0
+	for index := range picker.availability {
+		if _, ok := picker.partial[index]; ok || !picker.canPick(peer, index, choked) {
+			continue
+		}
+
+		if picker.completed >= RandomFirstPieces {
+			availability := picker.availability[index]
+			if len(candidates) > 0 && availability > rarest {
+				continue
+			}
+			if len(candidates) == 0 || availability < rarest {
+				candidates = candidates[:0]
+				rarest = availability
+			}
+		}
+		candidates = append(candidates, index)
+	}
+
+	// Break ties at random so that peers do not all fetch the same pieces
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	return candidates[randomUint32()%uint32(len(candidates))], true
+}
+
+// Allocates the blocks of a piece we start downloading.
+// A piece that failed with blocks from several peers is downloaded from a
+// single peer, so that the peer sending corrupt data can be told apart.
+func (picker *PiecePicker) startPiece(peer *downloadPeer, index int) {
+	size := picker.torrent.PieceSize(index)
+	numBlocks := (size + int(BlockSize) - 1) / int(BlockSize)
+	piece := &pickerPiece{
+		data:         make([]byte, size),
+		blocks:       make([]pickerBlock, numBlocks),
+		contributors: make(map[*Peer]bool),
+	}
+	if picker.suspect[index] {
+		piece.owner = peer
+	}
+	for i := range piece.blocks {
+		piece.blocks[i].requesters = make(map[*downloadPeer]bool)
+	}
+	picker.partial[index] = piece
+}
+
+// Marks a block as requested from a peer
+func (picker *PiecePicker) request(peer *downloadPeer, index int, block int) blockRequest {
+	picker.partial[index].blocks[block].requesters[peer] = true
+	return picker.blockRequest(index, block)
+}
+
+// Returns the request for a block of a piece, the last block may be shorter
+func (picker *PiecePicker) blockRequest(index int, block int) blockRequest {
+	begin := block * int(BlockSize)
+	length := int(BlockSize)
+	if begin+length > picker.torrent.PieceSize(index) {
+		length = picker.torrent.PieceSize(index) - begin
+	}
+	return blockRequest{index: index, begin: begin, length: length}
+}
+
+// Stores a block received from a peer. Returns the other peers the block
+// was requested from, which should be sent a Cancel, and the piece data
+// once all of its blocks are received.
+func (picker *PiecePicker) Received(peer *downloadPeer, request blockRequest, data []byte) ([]*downloadPeer, []byte) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	piece, ok := picker.partial[request.index]
+	if !ok {
+		return nil, nil
+	}
+	block := &piece.blocks[request.begin/int(BlockSize)]
+	delete(block.requesters, peer)
+	if block.done {
+		return nil, nil
+	}
+
+	copy(piece.data[request.begin:], data)
+	block.done = true
+	piece.received++
+	piece.contributors[peer.peer] = true
+
+	cancels := []*downloadPeer{}
+	for other := range block.requesters {
+		cancels = append(cancels, other)
+	}
+	block.requesters = make(map[*downloadPeer]bool)
+
+	if piece.received < len(piece.blocks) {
+		return cancels, nil
+	}
+	return cancels, piece.data
+}
+
+// Marks a piece as verified. The peers that failed it before no longer matter.
+func (picker *PiecePicker) PieceVerified(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	delete(picker.partial, index)
+	delete(picker.failed, index)
+	delete(picker.suspect, index)
+	if picker.wanted.Has(index) {
+		picker.wanted.Clear(index)
+		picker.remaining--
+		picker.completed++
+	}
+}
+
+// pickerCancel is a request to cancel on a peer
+type pickerCancel struct {
+	peer    *downloadPeer
+	request blockRequest
+}
+
+// Discards a piece that failed the hash check so that it is downloaded again.
+// Returns the peer that sent the corrupt data when all the blocks came from
+// it, that peer is not asked for the piece again while other peers have it.
+// Also returns the requests still pending for the piece, which should be cancelled.
+func (picker *PiecePicker) PieceFailed(index int) (*Peer, []pickerCancel) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	piece, ok := picker.partial[index]
+	if !ok {
+		return nil, nil
+	}
+	delete(picker.partial, index)
+
+	cancels := []pickerCancel{}
+	for i, block := range piece.blocks {
+		for peer := range block.requesters {
+			cancels = append(cancels, pickerCancel{peer: peer, request: picker.blockRequest(index, i)})
+		}
+	}
+
+	if len(piece.contributors) != 1 {
+		picker.suspect[index] = true
+		return nil, cancels
+	}
+	for peer := range piece.contributors {
+		if picker.failed[index] == nil {
+			picker.failed[index] = make(map[*Peer]bool)
+		}
+		picker.failed[index][peer] = true
+		return peer, cancels
+	}
+	return nil, cancels
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Returns a torrent of the given length cut in pieces of pieceLen bytes
+func pickerTorrent(length int, pieceLen int) *TorrentFile {
+	numPieces := (length + pieceLen - 1) / pieceLen
+	return &TorrentFile{Info: Info{Length: length, PieceLen: pieceLen, Pieces: make([]string, numPieces)}}
+}
+
+// Returns an unchoked peer having the given pieces
+func pickerPeer(torrent *TorrentFile, port uint16, pieces ...int) *downloadPeer {
+	peer := &Peer{Addr: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port)}
+	conn := &PeerConnection{Peer: peer, Bitfield: NewBitmap(torrent.NumPieces())}
+	for _, index := range pieces {
+		conn.Bitfield.Set(index)
+	}
+	return &downloadPeer{peer: peer, conn: conn, pending: make(map[blockRequest]bool)}
+}
+
+// Returns all the pieces of a torrent
+func allPieces(torrent *TorrentFile) []int {
+	pieces := []int{}
+	for i := 0; i < torrent.NumPieces(); i++ {
+		pieces = append(pieces, i)
+	}
+	return pieces
+}
+
+// Picks until the picker has nothing more for the peer
+func pickAll(picker *PiecePicker, peer *downloadPeer) []blockRequest {
+	requests := []blockRequest{}
+	for {
+		request, ok := picker.Pick(peer)
+		if !ok {
+			return requests
+		}
+		requests = append(requests, request)
+	}
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	torrent := pickerTorrent(4*int(BlockSize), int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	picker.completed = RandomFirstPieces
+
+	seeder := pickerPeer(torrent, 1, 0, 1, 2, 3)
+	for _, peer := range []*downloadPeer{seeder, pickerPeer(torrent, 2, 0, 1, 2), pickerPeer(torrent, 3, 0, 1)} {
+		picker.AddBitfield(peer.conn.Bitfield)
+	}
+	picker.AddHave(0)
+
+	// Availability is now 4, 3, 2 and 1
+	order := []int{}
+	for _, request := range pickAll(picker, seeder) {
+		order = append(order, request.index)
+	}
+	if want := []int{3, 2, 1, 0}; !reflect.DeepEqual(order, want) {
+		t.Errorf("picked pieces %v, want %v", order, want)
+	}
+}
+
+func TestPiecePickerBlocks(t *testing.T) {
+	// Two full pieces of two blocks and a last piece of half a block
+	torrent := pickerTorrent(4*int(BlockSize)+int(BlockSize)/2, 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, []int{2, 0})
+	peer := pickerPeer(torrent, 1, 0, 1, 2)
+	picker.AddBitfield(peer.conn.Bitfield)
+
+	requests := pickAll(picker, peer)
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].index < requests[j].index || (requests[i].index == requests[j].index && requests[i].begin < requests[j].begin)
+	})
+	want := []blockRequest{
+		{0, 0, int(BlockSize)},
+		{0, int(BlockSize), int(BlockSize)},
+		{2, 0, int(BlockSize) / 2},
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("picked %v, want %v", requests, want)
+	}
+}
+
+func TestPiecePickerFinishesPartialPieces(t *testing.T) {
+	torrent := pickerTorrent(8*int(BlockSize), 4*int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	first := pickerPeer(torrent, 1, 0, 1)
+	second := pickerPeer(torrent, 2, 0, 1)
+
+	started, _ := picker.Pick(first)
+	next, _ := picker.Pick(second)
+	if next.index != started.index || next.begin != int(BlockSize) {
+		t.Errorf("second peer picked %v after %v, want the next block of the same piece", next, started)
+	}
+}
+
+func TestPiecePickerEndgame(t *testing.T) {
+	torrent := pickerTorrent(4*int(BlockSize), 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	a := pickerPeer(torrent, 1, 0)
+	b := pickerPeer(torrent, 2, 0, 1)
+
+	// No endgame while piece 1 is not requested: a has nothing else to offer
+	if got := pickAll(picker, a); len(got) != 2 {
+		t.Fatalf("a picked %v, want the 2 blocks of piece 0", got)
+	}
+	if got := pickAll(picker, b); len(got) != 4 {
+		t.Fatalf("b picked %v, want the 2 blocks of piece 1 then the 2 of piece 0 in endgame", got)
+	}
+
+	// Every block is requested: a is asked for the blocks of piece 0 it does not have yet, none here
+	if request, ok := picker.Pick(a); ok {
+		t.Errorf("a picked %v in endgame, want nothing", request)
+	}
+
+	// The first copy of a block cancels the other requests, the second is ignored
+	block := blockRequest{0, 0, int(BlockSize)}
+	cancels, data := picker.Received(a, block, make([]byte, BlockSize))
+	if len(cancels) != 1 || cancels[0] != b || data != nil {
+		t.Errorf("Received from a returned cancels %v and %d bytes, want a cancel for b", cancels, len(data))
+	}
+	cancels, data = picker.Received(b, block, make([]byte, BlockSize))
+	if len(cancels) != 0 || data != nil {
+		t.Errorf("duplicate block returned cancels %v and %d bytes, want nothing", cancels, len(data))
+	}
+
+	cancels, data = picker.Received(b, blockRequest{0, int(BlockSize), int(BlockSize)}, make([]byte, BlockSize))
+	if len(cancels) != 1 || cancels[0] != a || len(data) != 2*int(BlockSize) {
+		t.Errorf("last block returned cancels %v and %d bytes, want a cancel for a and the piece", cancels, len(data))
+	}
+}
+
+func TestPiecePickerEndgamePrefersLeastRequested(t *testing.T) {
+	torrent := pickerTorrent(2*int(BlockSize), 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	a := pickerPeer(torrent, 1, 0)
+	b := pickerPeer(torrent, 2, 0)
+	c := pickerPeer(torrent, 3, 0)
+
+	pickAll(picker, a)
+	first, _ := picker.Pick(b)
+	second, _ := picker.Pick(c)
+	if first == second {
+		t.Errorf("b and c were both asked for %v, want different blocks", first)
+	}
+}
+
+func TestPiecePickerUnrequest(t *testing.T) {
+	torrent := pickerTorrent(2*int(BlockSize), 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	a := pickerPeer(torrent, 1, 0)
+	b := pickerPeer(torrent, 2, 0)
+
+	requests := pickAll(picker, a)
+	picker.Unrequest(a, requests[1:])
+
+	// The given back block goes to the next peer before any endgame duplicate
+	request, ok := picker.Pick(b)
+	if !ok || request != requests[1] {
+		t.Errorf("b picked %v, want %v", request, requests[1])
+	}
+}
+
+func TestPiecePickerChoked(t *testing.T) {
+	torrent := pickerTorrent(4*int(BlockSize), int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	peer := pickerPeer(torrent, 1, 0, 1, 2, 3)
+	peer.conn.PeerChoking = true
+
+	if request, ok := picker.Pick(peer); ok {
+		t.Errorf("choked peer was asked for %v", request)
+	}
+	peer.conn.AllowedFast = map[int]bool{2: true}
+	if request, ok := picker.Pick(peer); !ok || request.index != 2 {
+		t.Errorf("choked peer was asked for %v, want its allowed fast piece 2", request)
+	}
+}
+
+func TestPiecePickerFailures(t *testing.T) {
+	torrent := pickerTorrent(2*int(BlockSize), 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, allPieces(torrent))
+	a := pickerPeer(torrent, 1, 0)
+	b := pickerPeer(torrent, 2, 0)
+	picker.AddBitfield(a.conn.Bitfield)
+	picker.AddBitfield(b.conn.Bitfield)
+
+	// Corrupt data from a single peer: that peer is blamed and not asked again while b has the piece
+	for _, request := range pickAll(picker, a) {
+		picker.Received(a, request, make([]byte, request.length))
+	}
+	if blamed, _ := picker.PieceFailed(0); blamed != a.peer {
+		t.Errorf("PieceFailed blamed %v, want %v", blamed, a.peer)
+	}
+	if request, ok := picker.Pick(a); ok {
+		t.Errorf("blamed peer was asked for %v", request)
+	}
+
+	// Once b is gone, a is the only peer left with the piece and is asked again
+	picker.RemovePeer(b)
+	if _, ok := picker.Pick(a); !ok {
+		t.Errorf("blamed peer was not asked again when no other peer has the piece")
+	}
+
+	// Corrupt data from two peers: nobody is blamed, the piece then comes from one peer
+	picker = NewPiecePicker(torrent, allPieces(torrent))
+	first, _ := picker.Pick(a)
+	second, _ := picker.Pick(b)
+	picker.Received(a, first, make([]byte, first.length))
+	picker.Received(b, second, make([]byte, second.length))
+	if blamed, _ := picker.PieceFailed(0); blamed != nil {
+		t.Errorf("PieceFailed blamed %v for a piece from two peers", blamed)
+	}
+	if got := pickAll(picker, b); len(got) != 2 {
+		t.Errorf("b picked %v, want both blocks", got)
+	}
+	if request, ok := picker.Pick(a); ok {
+		t.Errorf("a was asked for %v of a piece owned by b", request)
+	}
+
+	picker.PieceVerified(0)
+	if picker.remaining != 0 || picker.completed != 1 || len(picker.suspect) != 0 {
+		t.Errorf("after PieceVerified remaining = %d, completed = %d and %d suspect pieces, want 0, 1 and 0", picker.remaining, picker.completed, len(picker.suspect))
+	}
+}
+
+func TestPiecePickerFailureCancelsPendingRequests(t *testing.T) {
+	torrent := pickerTorrent(4*int(BlockSize), 2*int(BlockSize))
+	picker := NewPiecePicker(torrent, []int{0})
+	a := pickerPeer(torrent, 1, 0)
+	b := pickerPeer(torrent, 2, 0)
+
+	// Both peers are asked for both blocks in endgame
+	pickAll(picker, a)
+	if got := pickAll(picker, b); len(got) != 2 {
+		t.Fatalf("b picked %v, want both blocks in endgame", got)
+	}
+	first := blockRequest{0, 0, int(BlockSize)}
+	picker.Received(a, first, make([]byte, BlockSize))
+
+	// The piece is dropped with the second block still requested from both peers
+	_, cancels := picker.PieceFailed(0)
+	second := blockRequest{0, int(BlockSize), int(BlockSize)}
+	cancelled := map[*downloadPeer]blockRequest{}
+	for _, cancel := range cancels {
+		cancelled[cancel.peer] = cancel.request
+	}
+	if len(cancels) != 2 || cancelled[a] != second || cancelled[b] != second {
+		t.Errorf("PieceFailed cancels %v, want %v on both peers", cancels, second)
+	}
+
+	// The piece starts over with no requester left
+	if got := pickAll(picker, b); len(got) != 2 || got[0] != first {
+		t.Errorf("b picked %v after the failure, want the piece again", got)
+	}
+}
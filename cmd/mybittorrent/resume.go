@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Minimum time between two saves of the resume file
+const ResumeSaveInterval = time.Second
+
+// ResumeFile records which pieces of a download are already complete,
+// so that an interrupted download only fetches the missing pieces.
+type ResumeFile struct {
+	Path     string
+	InfoHash []byte
+	Pieces   Bitmap
+	lastSave time.Time
+}
+
+// Returns the path of the resume file kept next to the downloaded content
+func ResumePath(torrent *TorrentFile, destPath string) string {
+	if torrent.Info.IsMultiFile() {
+		return filepath.Join(destPath, torrent.Info.Name) + ".resume"
+	}
+	return destPath + ".resume"
+}
+
+// Loads the resume file of a download.
+// Returns an empty resume file when there is none or it belongs to another torrent.
+func LoadResumeFile(torrent *TorrentFile, destPath string) (*ResumeFile, bool) {
+	resume := ResumeFile{
+		Path:     ResumePath(torrent, destPath),
+		InfoHash: torrent.InfoHash,
+		Pieces:   NewBitmap(torrent.NumPieces()),
+	}
+
+	content, err := os.ReadFile(resume.Path)
+	if err != nil {
+		return &resume, false
+	}
+
+	decoded, _, err := decodeBencode(string(content))
+	if err != nil {
+		fmt.Printf("Ignoring invalid resume file %s: %v\n", resume.Path, err)
+		return &resume, false
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return &resume, false
+	}
+	infoHash, _ := dict["info hash"].(string)
+	pieces, _ := dict["pieces"].(string)
+	if !bytes.Equal([]byte(infoHash), torrent.InfoHash) || len(pieces) != len(resume.Pieces) {
+		fmt.Printf("Ignoring resume file %s of another torrent\n", resume.Path)
+		return &resume, false
+	}
+
+	copy(resume.Pieces, pieces)
+	return &resume, true
+}
+
+// Writes the resume file, replacing the previous one atomically
+func (resume *ResumeFile) Save() error {
+	encoded, err := encodeBencode(map[string]interface{}{
+		"info hash": string(resume.InfoHash),
+		"pieces":    string(resume.Pieces),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := resume.Path + ".tmp"
+	err = os.WriteFile(tmpPath, []byte(encoded), 0644)
+	if err != nil {
+		return err
+	}
+	resume.lastSave = time.Now()
+	return os.Rename(tmpPath, resume.Path)
+}
+
+// Marks a piece as complete, saving the resume file at most once per interval
+func (resume *ResumeFile) SetPiece(pieceIndex int) error {
+	resume.Pieces.Set(pieceIndex)
+	if time.Since(resume.lastSave) < ResumeSaveInterval {
+		return nil
+	}
+	return resume.Save()
+}
+
+// Deletes the resume file once the download is complete
+func (resume *ResumeFile) Remove() error {
+	err := os.Remove(resume.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Checks if any of the files of a download already exists on disk
+func hasExistingData(torrent *TorrentFile, destPath string) bool {
+	for _, entry := range torrent.FileEntries(destPath) {
+		if _, err := os.Stat(entry.Path); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a single-file torrent of the given number of pieces
+func resumeTorrent(infoHash byte, numPieces int) *TorrentFile {
+	return &TorrentFile{
+		InfoHash: bytes.Repeat([]byte{infoHash}, 20),
+		Info:     Info{Name: "file", Length: numPieces * 1024, PieceLen: 1024, Pieces: make([]string, numPieces)},
+	}
+}
+
+func TestResumePath(t *testing.T) {
+	torrent := resumeTorrent(0xaa, 1)
+	if got := ResumePath(torrent, "out/file.bin"); got != "out/file.bin.resume" {
+		t.Errorf("ResumePath of a single file = %q, want %q", got, "out/file.bin.resume")
+	}
+	torrent.Info.Files = []File{{Length: 1024, Path: []string{"a"}}}
+	if got, want := ResumePath(torrent, "out"), filepath.Join("out", "file")+".resume"; got != want {
+		t.Errorf("ResumePath of a directory = %q, want %q", got, want)
+	}
+}
+
+func TestResumeFileRoundTrip(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "file")
+	torrent := resumeTorrent(0xaa, 12)
+
+	resume, ok := LoadResumeFile(torrent, destPath)
+	if ok || resume.Pieces.Count() != 0 {
+		t.Fatalf("loaded %d pieces without a resume file", resume.Pieces.Count())
+	}
+
+	// The first piece is saved at once, the next one waits for the interval
+	if err := resume.SetPiece(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := resume.SetPiece(11); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := LoadResumeFile(torrent, destPath)
+	if !ok || !loaded.Pieces.Has(0) || loaded.Pieces.Has(11) {
+		t.Errorf("loaded pieces %08b after the throttled save, want piece 0 only", loaded.Pieces)
+	}
+
+	if err := resume.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok = LoadResumeFile(torrent, destPath)
+	if !ok || !bytes.Equal(loaded.Pieces, resume.Pieces) {
+		t.Errorf("loaded pieces %08b, want %08b", loaded.Pieces, resume.Pieces)
+	}
+
+	if err := resume.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(resume.Path); !os.IsNotExist(err) {
+		t.Errorf("resume file still exists after Remove: %v", err)
+	}
+	if err := resume.Remove(); err != nil {
+		t.Errorf("second Remove failed: %v", err)
+	}
+}
+
+func TestLoadResumeFileIgnoresOtherTorrents(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "file")
+	saved, _ := LoadResumeFile(resumeTorrent(0xaa, 12), destPath)
+	saved.Pieces.Set(3)
+	if err := saved.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		torrent *TorrentFile
+	}{
+		{"other info hash", resumeTorrent(0xbb, 12)},
+		{"other number of pieces", resumeTorrent(0xaa, 20)},
+	}
+	for _, test := range tests {
+		resume, ok := LoadResumeFile(test.torrent, destPath)
+		if ok || resume.Pieces.Count() != 0 {
+			t.Errorf("%s: loaded %d pieces, want none", test.name, resume.Pieces.Count())
+		}
+	}
+
+	if err := os.WriteFile(saved.Path, []byte("not bencode"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resume, ok := LoadResumeFile(resumeTorrent(0xaa, 12), destPath); ok || resume.Pieces.Count() != 0 {
+		t.Errorf("invalid resume file: loaded %d pieces, want none", resume.Pieces.Count())
+	}
+}
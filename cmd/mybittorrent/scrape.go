@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Most info hashes in a UDP scrape, so that the request and the response fit in a packet
+const MaxUDPScrapeHashes = 74
+
+// ScrapeStats is the swarm of a torrent as counted by a tracker
+type ScrapeStats struct {
+	Seeders   int
+	Completed int // peers that ever finished the download
+	Leechers  int
+}
+
+// scrapeResult is the answer of a tracker for all the torrents it was asked about
+type scrapeResult struct {
+	stats map[string]ScrapeStats // by info hash
+	err   error
+}
+
+// Asks every tracker of the torrents for the size of their swarms and prints it.
+// A tracker used by several torrents is scraped once for all of them.
+func Scrape(torrents []*TorrentFile) {
+	// Group the info hashes by tracker, keeping the trackers in order
+	trackers := []string{}
+	infoHashes := make(map[string][][]byte)
+	for _, torrent := range torrents {
+		for _, tier := range torrent.trackerTiers() {
+			for _, tracker := range tier {
+				if _, ok := infoHashes[tracker]; !ok {
+					trackers = append(trackers, tracker)
+				}
+				infoHashes[tracker] = append(infoHashes[tracker], torrent.InfoHash)
+			}
+		}
+	}
+
+	// Scrape the trackers at the same time
+	results := make([]scrapeResult, len(trackers))
+	var wg sync.WaitGroup
+	for i, tracker := range trackers {
+		i, tracker := i, tracker
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, err := scrapeTracker(tracker, infoHashes[tracker])
+			results[i] = scrapeResult{stats: stats, err: err}
+		}()
+	}
+	wg.Wait()
+
+	for _, torrent := range torrents {
+		if torrent.Info.Name != "" {
+			fmt.Printf("%s %x\n", torrent.Info.Name, torrent.InfoHash)
+		} else {
+			fmt.Printf("%x\n", torrent.InfoHash)
+		}
+		if len(torrent.trackerTiers()) == 0 {
+			fmt.Println("  No trackers")
+		}
+		for i, tracker := range trackers {
+			if !hasInfoHash(infoHashes[tracker], torrent.InfoHash) {
+				continue
+			}
+			result := results[i]
+			stats, ok := result.stats[string(torrent.InfoHash)]
+			switch {
+			case result.err != nil:
+				fmt.Printf("  %s: %v\n", tracker, result.err)
+			case !ok:
+				fmt.Printf("  %s: torrent not tracked\n", tracker)
+			default:
+				fmt.Printf("  %s: seeders: %d, completed: %d, leechers: %d\n", tracker, stats.Seeders, stats.Completed, stats.Leechers)
+			}
+		}
+	}
+}
+
+// Loads a torrent file, or the info hash and trackers of a magnet link without fetching its metadata
+func loadScrapeTorrent(arg string) (*TorrentFile, error) {
+	if !isMagnet(arg) {
+		return parseFile(arg)
+	}
+	magnet, err := ParseMagnet(arg)
+	if err != nil {
+		return nil, err
+	}
+	return magnetTorrent(magnet), nil
+}
+
+// Checks if an info hash is in a list
+func hasInfoHash(infoHashes [][]byte, infoHash []byte) bool {
+	for _, candidate := range infoHashes {
+		if string(candidate) == string(infoHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrapes a tracker using the protocol of its URL
+func scrapeTracker(announceUrl string, infoHashes [][]byte) (map[string]ScrapeStats, error) {
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedUrl.Scheme {
+	case "http", "https":
+		return scrapeHTTP(announceUrl, infoHashes)
+	case "udp":
+		return scrapeUDP(parsedUrl.Host, infoHashes)
+	default:
+		return nil, fmt.Errorf("Unsupported tracker protocol %s", parsedUrl.Scheme)
+	}
+}
+
+// Derives the scrape URL of an HTTP tracker from its announce URL:
+// the last path component must start with "announce", which is replaced by "scrape".
+func deriveScrapeUrl(announceUrl string) (string, error) {
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	slash := strings.LastIndex(parsedUrl.Path, "/")
+	last := parsedUrl.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("Tracker does not support scrape")
+	}
+	parsedUrl.Path = parsedUrl.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	parsedUrl.RawPath = ""
+	return parsedUrl.String(), nil
+}
+
+// Scrapes an HTTP tracker for several torrents in one request
+func scrapeHTTP(announceUrl string, infoHashes [][]byte) (map[string]ScrapeStats, error) {
+	scrapeUrl, err := deriveScrapeUrl(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", scrapeUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	for _, infoHash := range infoHashes {
+		q.Add("info_hash", string(infoHash))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	dict, err := getTrackerDict(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// files maps every info hash to its complete, downloaded and incomplete counts
+	files, _ := dict["files"].(map[string]interface{})
+	stats := make(map[string]ScrapeStats)
+	for infoHash, value := range files {
+		file, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		seeders, _ := file["complete"].(int)
+		completed, _ := file["downloaded"].(int)
+		leechers, _ := file["incomplete"].(int)
+		stats[infoHash] = ScrapeStats{Seeders: seeders, Completed: completed, Leechers: leechers}
+	}
+	return stats, nil
+}
+
+// Scrapes a UDP tracker, asking for up to MaxUDPScrapeHashes torrents per request
+func scrapeUDP(host string, infoHashes [][]byte) (map[string]ScrapeStats, error) {
+	tracker, err := dialUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.conn.Close()
+
+	stats := make(map[string]ScrapeStats)
+	for start := 0; start < len(infoHashes); start += MaxUDPScrapeHashes {
+		end := start + MaxUDPScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		// Scrape request after the header: the info hashes, 20 bytes each
+		payload := []byte{}
+		for _, infoHash := range infoHashes[start:end] {
+			payload = append(payload, infoHash...)
+		}
+		response, err := tracker.transact(udpActionScrape, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		// Scrape response: seeders, completed, leechers (4 bytes each) for every info hash in order
+		if len(response) < 12*(end-start) {
+			return nil, fmt.Errorf("Invalid scrape response from %s", host)
+		}
+		for i, infoHash := range infoHashes[start:end] {
+			entry := response[i*12 : i*12+12]
+			stats[string(infoHash)] = ScrapeStats{
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestDeriveScrapeUrl(t *testing.T) {
+	// The examples of the scrape convention, an empty scrape URL meaning no scrape support
+	tests := []struct {
+		announceUrl string
+		scrapeUrl   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/announce?passkey=abc", "http://example.com/scrape?passkey=abc"},
+		{"http://example.com/x%064announce", ""},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x/announce/y", ""},
+		{"http://example.com/", ""},
+	}
+
+	for _, test := range tests {
+		got, err := deriveScrapeUrl(test.announceUrl)
+		if test.scrapeUrl == "" {
+			if err == nil {
+				t.Errorf("deriveScrapeUrl(%q) = %q, want an error", test.announceUrl, got)
+			}
+			continue
+		}
+		if err != nil || got != test.scrapeUrl {
+			t.Errorf("deriveScrapeUrl(%q) = %q, %v, want %q", test.announceUrl, got, err, test.scrapeUrl)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of incoming peer connections
+	MaxInboundConnections = 50
+
+	// Largest block a peer may request
+	MaxRequestLength = 128 * 1024
+
+	// Maximum number of requests queued for a peer
+	MaxQueuedRequests = 250
+
+	// Peers that send nothing for this long are disconnected
+	PeerIdleTimeout = 3 * time.Minute
+)
+
+// blockRequest is a block requested by a peer
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// servedTorrent is a torrent whose verified pieces we upload
+type servedTorrent struct {
+	torrent *TorrentFile
+	storage *Storage
+	choker  *Choker
+	done    chan struct{}
+
+	mu    sync.Mutex
+	have  Bitmap
+	peers map[*PeerConnection]bool // inbound peers and the peers we download from
+}
+
+// Server accepts incoming peer connections and serves blocks of the torrents we have
+type Server struct {
+	listener    *net.TCPListener
+	utp         *utpSocket // nil when uTP is disabled or its port is taken
+	UploadSlots int        // peers unchoked by the choker of every torrent
+
+	mu       sync.Mutex
+	torrents map[string]*servedTorrent
+	inbound  int
+}
+
+// Starts listening for peers on a TCP port, falling back to any free port.
+// The port announced to the trackers is updated accordingly.
+// Unless only TCP is allowed, uTP connections are accepted on the same UDP port.
+func StartServer(port int) (*Server, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server := Server{
+		listener:    listener,
+		UploadSlots: DefaultUploadSlots,
+		torrents:    make(map[string]*servedTorrent),
+	}
+	announcePort = server.Port()
+	go server.acceptLoop(listener.Accept)
+
+	if transportPolicy != TransportTCP {
+		server.utp, err = listenUTP(server.Port(), true)
+		if err != nil {
+			fmt.Println("uTP disabled:", err)
+		} else {
+			setUTPDialSocket(server.utp)
+			go server.acceptLoop(server.utp.Accept)
+		}
+	}
+	return &server, nil
+}
+
+// Returns the port the server listens on
+func (server *Server) Port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Stops accepting peers and disconnects the connected ones
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	if server.utp != nil {
+		setUTPDialSocket(nil)
+		server.utp.Close()
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, served := range server.torrents {
+		close(served.done)
+		served.mu.Lock()
+		for peerConnection := range served.peers {
+			peerConnection.Conn.Close()
+		}
+		served.mu.Unlock()
+	}
+	return err
+}
+
+// Starts serving a torrent. have holds the pieces verified in the storage.
+func (server *Server) AddTorrent(torrent *TorrentFile, storage *Storage, have Bitmap) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	served := &servedTorrent{
+		torrent: torrent,
+		storage: storage,
+		done:    make(chan struct{}),
+		have:    append(Bitmap{}, have...),
+		peers:   make(map[*PeerConnection]bool),
+	}
+	served.choker = NewChoker(server.UploadSlots, served.isSeeding)
+	server.torrents[string(torrent.InfoHash)] = served
+
+	go served.choker.Run(served.done)
+}
+
+// Checks if we have all the pieces of the torrent
+func (served *servedTorrent) isSeeding() bool {
+	served.mu.Lock()
+	defer served.mu.Unlock()
+	return served.have.Count() == served.torrent.NumPieces()
+}
+
+// Returns a served torrent by its info hash, or nil when we do not serve it
+func (server *Server) lookup(infoHash []byte) *servedTorrent {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.torrents[string(infoHash)]
+}
+
+// Marks a piece as verified and tells the connected peers we have it,
+// the inbound ones as well as the ones we download from
+func (server *Server) PieceCompleted(infoHash []byte, pieceIndex int) {
+	served := server.lookup(infoHash)
+	if served == nil {
+		return
+	}
+
+	served.mu.Lock()
+	served.have.Set(pieceIndex)
+	peers := []*PeerConnection{}
+	for peerConnection := range served.peers {
+		peers = append(peers, peerConnection)
+	}
+	served.mu.Unlock()
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+	for _, peerConnection := range peers {
+		peerConnection.sendMessage(Have, payload)
+	}
+}
+
+// Sends our pieces to a peer and registers it, so that the pieces verified
+// from now on are announced to it with Have messages. Returns the pieces sent.
+func (served *servedTorrent) addPeer(peerConnection *PeerConnection) (Bitmap, error) {
+	// Register the peer while the bitfield is sent, so that a piece completed
+	// meanwhile is announced after the bitfield and not before it
+	served.mu.Lock()
+	defer served.mu.Unlock()
+	bitfield := append(Bitmap{}, served.have...)
+	err := peerConnection.sendHaves(bitfield, served.torrent.NumPieces())
+	if err != nil {
+		return nil, err
+	}
+	served.peers[peerConnection] = true
+	return bitfield, nil
+}
+
+// Stops announcing our pieces to a peer
+func (served *servedTorrent) removePeer(peerConnection *PeerConnection) {
+	served.mu.Lock()
+	defer served.mu.Unlock()
+	delete(served.peers, peerConnection)
+}
+
+// Returns the info hashes of the served torrents, to find the torrent of an encrypted connection
+func (server *Server) infoHashes() [][]byte {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	infoHashes := [][]byte{}
+	for _, served := range server.torrents {
+		infoHashes = append(infoHashes, served.torrent.InfoHash)
+	}
+	return infoHashes
+}
+
+// Accepts incoming connections until the listener is closed
+func (server *Server) acceptLoop(accept func() (net.Conn, error)) {
+	for {
+		conn, err := accept()
+		if err != nil {
+			return
+		}
+
+		server.mu.Lock()
+		full := server.inbound >= MaxInboundConnections
+		if !full {
+			server.inbound++
+		}
+		server.mu.Unlock()
+		if full {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			err := server.handleConnection(conn)
+			if err != nil {
+				fmt.Printf("Inbound peer %s: %v\n", conn.RemoteAddr(), err)
+			}
+			server.mu.Lock()
+			server.inbound--
+			server.mu.Unlock()
+		}()
+	}
+}
+
+// Answers the handshake of an incoming peer and serves it
+func (server *Server) handleConnection(conn net.Conn) error {
+	defer conn.Close()
+
+	localPeerId, err := getLocalId()
+	if err != nil {
+		return err
+	}
+
+	// Plaintext handshakes start with the protocol string, anything else is
+	// the public key of an encrypted connection
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	start := make([]byte, 20)
+	_, err = io.ReadFull(conn, start)
+	if err != nil {
+		return err
+	}
+	var stream net.Conn
+	var encryptedHash []byte
+	if start[0] == 19 && string(start[1:20]) == "BitTorrent protocol" {
+		if encryptionPolicy == EncryptionRequire {
+			return fmt.Errorf("Plaintext connection refused")
+		}
+		stream = &cryptoConn{Conn: conn, buffered: start}
+	} else {
+		if encryptionPolicy == EncryptionDisable {
+			return fmt.Errorf("Encrypted connection refused")
+		}
+		stream, encryptedHash, err = mseAccept(conn, start, server.infoHashes())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Read the handshake to learn which torrent the peer wants
+	reserved, infoHash, peerId, err := readHandshake(stream)
+	if err != nil {
+		return err
+	}
+	if encryptedHash != nil && !bytes.Equal(infoHash, encryptedHash) {
+		return fmt.Errorf("Handshake for %x on a connection encrypted for %x", infoHash, encryptedHash)
+	}
+
+	served := server.lookup(infoHash)
+	if served == nil {
+		return fmt.Errorf("Unknown info hash %x", infoHash)
+	}
+
+	err = writeHandshake(stream, infoHash, localPeerId)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer := remotePeer(conn)
+	peerConnection := newPeerConnection(peer, stream, peerId, reserved)
+	peerConnection.Bitfield = NewBitmap(served.torrent.NumPieces())
+	peerConnection.PiecesNum = served.torrent.NumPieces()
+	return served.servePeer(peerConnection)
+}
+
+// Sends our pieces to an inbound peer and answers its requests until it disconnects.
+// Peers with the extension protocol may also fetch the metadata from us.
+func (served *servedTorrent) servePeer(peerConnection *PeerConnection) error {
+	uploader, err := served.startUploads(peerConnection)
+	if err != nil {
+		return err
+	}
+	defer uploader.Close()
+
+	if peerConnection.SupportsExtensions() {
+		peerConnection.HandleExtension("ut_metadata", serveMetadata(served.torrent.Metadata))
+		err = peerConnection.sendExtendedHandshake(len(served.torrent.Metadata), served.torrent.Info.Private)
+		if err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go peerConnection.keepAlive(done)
+
+	for {
+		peerConnection.Conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+		messageType, payload, err := peerConnection.readMessage()
+		if err != nil {
+			return err
+		}
+		err = peerConnection.handleMessage(messageType, payload)
+		if err != nil {
+			return err
+		}
+		err = uploader.handleMessage(messageType, payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// uploader answers the block requests of a peer, inbound or one we download from.
+// Requests are queued by the reading loop of the connection and sent by a separate writer,
+// so that a Cancel can remove a request before its block is sent.
+// Peers with the Fast Extension get a Reject for every request we drop,
+// and may request the pieces of their allowed fast set while choked.
+type uploader struct {
+	served         *servedTorrent
+	peerConnection *PeerConnection
+	fast           bool
+	allowedFast    map[int]bool
+
+	mu     sync.Mutex
+	queue  []blockRequest
+	wakeup chan struct{}
+	done   chan struct{}
+}
+
+// Sends our pieces and the allowed fast set to a peer, then lets the choker manage it.
+// This must be the first message sent after the handshake.
+func (served *servedTorrent) startUploads(peerConnection *PeerConnection) (*uploader, error) {
+	bitfield, err := served.addPeer(peerConnection)
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := &uploader{
+		served:         served,
+		peerConnection: peerConnection,
+		fast:           peerConnection.SupportsFast(),
+		allowedFast:    make(map[int]bool),
+		wakeup:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if uploader.fast {
+		ip := peerConnection.Peer.IP()
+		for _, index := range allowedFastSet(ip, served.torrent.InfoHash, served.torrent.NumPieces(), AllowedFastSetSize) {
+			if !bitfield.Has(index) {
+				continue
+			}
+			uploader.allowedFast[index] = true
+			err = peerConnection.sendPieceIndex(AllowedFast, index)
+			if err != nil {
+				uploader.Close()
+				return nil, err
+			}
+		}
+	}
+
+	served.choker.Add(peerConnection)
+	go uploader.writeLoop()
+	return uploader, nil
+}
+
+// Stops answering the requests of the peer and removes it from the choker
+func (uploader *uploader) Close() {
+	close(uploader.done)
+	uploader.served.choker.Remove(uploader.peerConnection)
+	uploader.served.removePeer(uploader.peerConnection)
+}
+
+// Checks if a request may be answered in the current choking state
+func (uploader *uploader) canServe(request blockRequest) bool {
+	return !uploader.peerConnection.IsChoking() || uploader.allowedFast[request.index]
+}
+
+// Drops a request, telling the peer when it supports the Fast Extension
+func (uploader *uploader) reject(request blockRequest) error {
+	if !uploader.fast {
+		return nil
+	}
+	return uploader.peerConnection.sendReject(request)
+}
+
+// Sends the queued blocks until the uploader is closed
+func (uploader *uploader) writeLoop() {
+	for {
+		select {
+		case <-uploader.done:
+			return
+		case <-uploader.wakeup:
+		}
+
+		for {
+			uploader.mu.Lock()
+			if len(uploader.queue) == 0 {
+				uploader.mu.Unlock()
+				break
+			}
+			request := uploader.queue[0]
+			uploader.queue = uploader.queue[1:]
+			uploader.mu.Unlock()
+
+			// Requests are dropped, or rejected, once the choker chokes the peer
+			var err error
+			if uploader.canServe(request) {
+				err = uploader.served.sendBlock(uploader.peerConnection, request)
+			} else {
+				err = uploader.reject(request)
+			}
+			if err != nil {
+				uploader.peerConnection.Conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Acts on the messages about uploads: interest changes, requests and cancels.
+// The message must have been checked by handleMessage of the connection.
+func (uploader *uploader) handleMessage(messageType MessageType, payload []byte) error {
+	switch messageType {
+	case Interested, NotInterested:
+		// The choker decides when the peer is unchoked
+		uploader.served.choker.Trigger()
+	case Request:
+		request, err := parseBlockRequest(payload)
+		if err != nil {
+			return err
+		}
+		if !uploader.served.validRequest(request) {
+			if !uploader.fast {
+				return fmt.Errorf("Invalid request for piece %d at %d", request.index, request.begin)
+			}
+			return uploader.reject(request)
+		}
+		if !uploader.canServe(request) {
+			return uploader.reject(request)
+		}
+
+		uploader.mu.Lock()
+		queued := len(uploader.queue) < MaxQueuedRequests
+		if queued {
+			uploader.queue = append(uploader.queue, request)
+		}
+		uploader.mu.Unlock()
+		if !queued {
+			return uploader.reject(request)
+		}
+		select {
+		case uploader.wakeup <- struct{}{}:
+		default:
+		}
+	case Cancel:
+		request, err := parseBlockRequest(payload)
+		if err != nil {
+			return err
+		}
+
+		uploader.mu.Lock()
+		removed := false
+		for i, queued := range uploader.queue {
+			if queued == request {
+				uploader.queue = append(uploader.queue[:i], uploader.queue[i+1:]...)
+				removed = true
+				break
+			}
+		}
+		uploader.mu.Unlock()
+
+		// Every request of a Fast Extension peer is answered by a block or a Reject
+		if removed {
+			return uploader.reject(request)
+		}
+	}
+	return nil
+}
+
+// Parses the payload of a Request or Cancel message
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, fmt.Errorf("Invalid request message")
+	}
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+// Checks that a request is for a verified piece and inside of it
+func (served *servedTorrent) validRequest(request blockRequest) bool {
+	served.mu.Lock()
+	has := served.have.Has(request.index)
+	served.mu.Unlock()
+
+	if !has || request.length <= 0 || request.length > MaxRequestLength || request.begin < 0 {
+		return false
+	}
+	return request.begin+request.length <= served.torrent.PieceSize(request.index)
+}
+
+// Reads a block from the storage and sends it in a Piece message
+func (served *servedTorrent) sendBlock(peerConnection *PeerConnection, request blockRequest) error {
+	payload := make([]byte, 8+request.length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(request.index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(request.begin))
+
+	offset := int64(request.index)*int64(served.torrent.Info.PieceLen) + int64(request.begin)
+	err := served.storage.ReadAt(payload[8:], offset)
+	if err != nil {
+		return err
+	}
+
+	_, err = peerConnection.sendMessage(Piece, payload)
+	if err != nil {
+		return err
+	}
+	peerConnection.Stats.AddUploaded(request.length)
+	served.torrent.Transfer.AddUploaded(request.length)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Storage maps the stream of pieces of a torrent to its files on disk
+type Storage struct {
+	torrent *TorrentFile
+	files   []storageFile
+}
+
+// storageFile is an open file of the torrent
+type storageFile struct {
+	entry FileEntry
+	file  *os.File
+}
+
+// Opens the files of a torrent inside destPath, creating the missing
+// files and directories and preallocating every file to its final size.
+func OpenStorage(torrent *TorrentFile, destPath string) (*Storage, error) {
+	storage := Storage{torrent: torrent}
+
+	for _, entry := range torrent.FileEntries(destPath) {
+		err := os.MkdirAll(filepath.Dir(entry.Path), 0755)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+
+		file, err := os.OpenFile(entry.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+		storage.files = append(storage.files, storageFile{entry: entry, file: file})
+
+		// Preallocate the file so that pieces can be written at any offset
+		err = file.Truncate(int64(entry.Length))
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	return &storage, nil
+}
+
+// Opens the files of a torrent inside destPath for reading only.
+// Missing files are allowed, reading from them fails.
+func OpenStorageReadOnly(torrent *TorrentFile, destPath string) (*Storage, error) {
+	storage := Storage{torrent: torrent}
+
+	for _, entry := range torrent.FileEntries(destPath) {
+		file, err := os.Open(entry.Path)
+		if err != nil && !os.IsNotExist(err) {
+			storage.Close()
+			return nil, err
+		}
+		if err != nil {
+			file = nil
+		}
+		storage.files = append(storage.files, storageFile{entry: entry, file: file})
+	}
+
+	return &storage, nil
+}
+
+// Checks if a file of the storage exists on disk with its full length
+func (storage *Storage) hasFile(fileIndex int) (exists bool, complete bool) {
+	file := storage.files[fileIndex].file
+	if file == nil {
+		return false, false
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, false
+	}
+	return true, fileInfo.Size() == int64(storage.files[fileIndex].entry.Length)
+}
+
+// Closes all the files of the storage
+func (storage *Storage) Close() error {
+	var firstErr error
+	for _, storageFile := range storage.files {
+		if storageFile.file == nil {
+			continue
+		}
+		err := storageFile.file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	storage.files = nil
+	return firstErr
+}
+
+// Calls fn for every part of the files covered by length bytes at offset.
+// fn receives the file, the offset inside the file and the range of the buffer.
+func (storage *Storage) forEachSpan(offset int64, length int, fn func(file *os.File, fileOffset int64, start int, end int) error) error {
+	if offset < 0 || offset+int64(length) > int64(storage.torrent.Info.Length) {
+		return fmt.Errorf("Range %d+%d out of bounds", offset, length)
+	}
+
+	position := 0
+	for _, storageFile := range storage.files {
+		if position == length {
+			break
+		}
+
+		fileStart := int64(storageFile.entry.Offset)
+		fileEnd := fileStart + int64(storageFile.entry.Length)
+		current := offset + int64(position)
+		if current >= fileEnd || current < fileStart {
+			continue
+		}
+
+		// Take as much as possible from this file
+		n := int(fileEnd - current)
+		if n > length-position {
+			n = length - position
+		}
+
+		err := fn(storageFile.file, current-fileStart, position, position+n)
+		if err != nil {
+			return err
+		}
+		position += n
+	}
+
+	return nil
+}
+
+// Writes data at an offset of the stream of pieces, spanning files if needed
+func (storage *Storage) WriteAt(data []byte, offset int64) error {
+	return storage.forEachSpan(offset, len(data), func(file *os.File, fileOffset int64, start int, end int) error {
+		_, err := file.WriteAt(data[start:end], fileOffset)
+		return err
+	})
+}
+
+// Reads data at an offset of the stream of pieces, spanning files if needed
+func (storage *Storage) ReadAt(data []byte, offset int64) error {
+	return storage.forEachSpan(offset, len(data), func(file *os.File, fileOffset int64, start int, end int) error {
+		_, err := file.ReadAt(data[start:end], fileOffset)
+		return err
+	})
+}
+
+// Writes a verified piece at its position in the files
+func (storage *Storage) WritePiece(pieceIndex int, data []byte) error {
+	if len(data) != storage.torrent.PieceSize(pieceIndex) {
+		return fmt.Errorf("Piece %d has length %d, expected %d", pieceIndex, len(data), storage.torrent.PieceSize(pieceIndex))
+	}
+	return storage.WriteAt(data, int64(pieceIndex)*int64(storage.torrent.Info.PieceLen))
+}
+
+// Reads a piece from the files
+func (storage *Storage) ReadPiece(pieceIndex int) ([]byte, error) {
+	if pieceIndex < 0 || pieceIndex >= storage.torrent.NumPieces() {
+		return nil, fmt.Errorf("Piece %d out of range", pieceIndex)
+	}
+	data := make([]byte, storage.torrent.PieceSize(pieceIndex))
+	err := storage.ReadAt(data, int64(pieceIndex)*int64(storage.torrent.Info.PieceLen))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -4,21 +4,46 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 // TorrentFile represents a torrent file
 type TorrentFile struct {
-	Announce string
-	Info     Info
-	InfoHash []byte
-	Path     string
+	Announce     string
+	AnnounceList [][]string // tiers of trackers (BEP 12), shuffled when parsed
+	Info         Info
+	InfoHash     []byte
+	Metadata     []byte // bencoded info dictionary, sent to peers with ut_metadata
+	Path         string
+
+	trackersMu sync.Mutex        // guards the order of the trackers in AnnounceList and the tracker ids
+	trackerIds map[string]string // tracker id given by each tracker, by announce URL
+
+	Transfer TransferStats // data exchanged with peers, reported to the trackers
 }
 
 type Info struct {
-	Length   int
+	Length   int // total length of all files
 	Name     string
 	PieceLen int
 	Pieces   []string
+	Files    []File // empty for single-file torrents
+	Private  bool   // peers may only be found through the trackers
+}
+
+// File represents one of the files of a multi-file torrent
+type File struct {
+	Length int
+	Path   []string // path components relative to the torrent name
+}
+
+// FileEntry is a file on disk together with its position in the stream of pieces
+type FileEntry struct {
+	Path   string
+	Length int
+	Offset int
 }
 
 // Creates a TorrentFile instance from a torrent file path
@@ -63,49 +88,242 @@ func parseFile(filepath string) (*TorrentFile, error) {
 	}
 
 	// Get values
-	announce := decoded.(map[string]interface{})["announce"].(string)
-	infoDecoded := decoded.(map[string]interface{})["info"].(map[string]interface{})
-	length := infoDecoded["length"].(int)
-	name := infoDecoded["name"].(string)
-	pieceLen := infoDecoded["piece length"].(int)
-	piecesStr := infoDecoded["pieces"].(string)
+	announce, _ := decoded.(map[string]interface{})["announce"].(string)
+	infoDecoded, ok := decoded.(map[string]interface{})["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Torrent file has no info dictionary")
+	}
+	info, err := parseInfo(infoDecoded)
+	if err != nil {
+		return nil, err
+	}
+	announceList := parseAnnounceList(decoded.(map[string]interface{})["announce-list"])
+
+	// Hash info
+	metadata, err := encodeBencode(infoDecoded)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	infoHash := hashInfo([]byte(metadata))
+
+	torrent := TorrentFile{
+		Announce:     announce,
+		AnnounceList: announceList,
+		Info:         *info,
+		InfoHash:     infoHash,
+		Metadata:     []byte(metadata),
+		Path:         filepath,
+	}
+
+	return &torrent, nil
+}
+
+// Parses the announce-list of a torrent into tiers of tracker URLs.
+// The trackers of each tier are shuffled as required by BEP 12.
+func parseAnnounceList(announceListDecoded interface{}) [][]string {
+	tiersDecoded, ok := announceListDecoded.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	announceList := [][]string{}
+	for _, tierDecoded := range tiersDecoded {
+		trackersDecoded, ok := tierDecoded.([]interface{})
+		if !ok {
+			continue
+		}
+
+		tier := []string{}
+		for _, trackerDecoded := range trackersDecoded {
+			if tracker, ok := trackerDecoded.(string); ok && tracker != "" {
+				tier = append(tier, tracker)
+			}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		shuffleStrings(tier)
+		announceList = append(announceList, tier)
+	}
+
+	return announceList
+}
+
+// Shuffles a list of strings in place
+func shuffleStrings(list []string) {
+	for i := len(list) - 1; i > 0; i-- {
+		j := int(randomUint32() % uint32(i+1))
+		list[i], list[j] = list[j], list[i]
+	}
+}
+
+// Returns the tiers of trackers of the torrent.
+// Without an announce-list the announce URL is the only tier.
+func (torrent *TorrentFile) trackerTiers() [][]string {
+	if len(torrent.AnnounceList) > 0 {
+		return torrent.AnnounceList
+	}
+	if torrent.Announce != "" {
+		return [][]string{{torrent.Announce}}
+	}
+	return nil
+}
+
+// Parses the info dictionary of a torrent
+func parseInfo(infoDecoded map[string]interface{}) (*Info, error) {
+	name, ok := infoDecoded["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Info dictionary has no name")
+	}
+
+	// The name is the directory of multi-file torrents, it must stay inside the destination
+	if !isSafePathComponent(name) {
+		return nil, fmt.Errorf("Invalid torrent name %q", name)
+	}
+	pieceLen, ok := infoDecoded["piece length"].(int)
+	if !ok || pieceLen <= 0 {
+		return nil, fmt.Errorf("Info dictionary has no valid piece length")
+	}
+	piecesStr, ok := infoDecoded["pieces"].(string)
+	if !ok || len(piecesStr)%20 != 0 {
+		return nil, fmt.Errorf("Info dictionary has no valid pieces")
+	}
 	pieces := []string{}
 	for i := 0; i < len(piecesStr); i += 20 {
 		pieces = append(pieces, piecesStr[i:i+20])
 	}
 
+	private, _ := infoDecoded["private"].(int)
 	info := Info{
-		Length:   length,
 		Name:     name,
 		PieceLen: pieceLen,
 		Pieces:   pieces,
+		Private:  private == 1,
 	}
 
-	// Hash info
-	infoHash, err := hashInfo(infoDecoded)
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
+	// Single-file torrents have a length, multi-file torrents a list of files
+	if length, ok := infoDecoded["length"].(int); ok {
+		info.Length = length
+	} else if filesDecoded, ok := infoDecoded["files"].([]interface{}); ok {
+		for _, fileDecoded := range filesDecoded {
+			file, err := parseInfoFile(fileDecoded)
+			if err != nil {
+				return nil, err
+			}
+			info.Files = append(info.Files, *file)
+			info.Length += file.Length
+		}
+	} else {
+		return nil, fmt.Errorf("Info dictionary has neither length nor files")
 	}
 
-	torrent := TorrentFile{
-		Announce: announce,
-		Info:     info,
-		InfoHash: infoHash,
-		Path:     filepath,
+	// The pieces must cover exactly the whole content
+	expectedPieces := (info.Length + pieceLen - 1) / pieceLen
+	if expectedPieces != len(pieces) {
+		return nil, fmt.Errorf("Expected %d piece hashes, got=%d", expectedPieces, len(pieces))
 	}
 
-	return &torrent, nil
+	return &info, nil
 }
 
-// Hashes the info dictionary
-func hashInfo(infoDecoded map[string]interface{}) ([]byte, error) {
-	encodedInfo, err := encodeBencode(infoDecoded)
-	if err != nil {
-		return nil, err
+// Parses an entry of the files list of a multi-file torrent
+func parseInfoFile(fileDecoded interface{}) (*File, error) {
+	fileDict, ok := fileDecoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid entry in files list")
+	}
+	length, ok := fileDict["length"].(int)
+	if !ok || length < 0 {
+		return nil, fmt.Errorf("File has no valid length")
+	}
+	pathDecoded, ok := fileDict["path"].([]interface{})
+	if !ok || len(pathDecoded) == 0 {
+		return nil, fmt.Errorf("File has no path")
+	}
+
+	path := []string{}
+	for _, component := range pathDecoded {
+		componentStr, ok := component.(string)
+		if !ok || !isSafePathComponent(componentStr) {
+			return nil, fmt.Errorf("Invalid path component %v", component)
+		}
+		path = append(path, componentStr)
 	}
+
+	return &File{Length: length, Path: path}, nil
+}
+
+// Checks that a path component cannot escape the download directory
+func isSafePathComponent(component string) bool {
+	if component == "" || component == "." || component == ".." {
+		return false
+	}
+	return !strings.ContainsAny(component, "/\\\x00")
+}
+
+// Returns true when the torrent contains a directory of files
+func (info *Info) IsMultiFile() bool {
+	return len(info.Files) > 0
+}
+
+// Returns the files of the torrent as they are laid out on disk.
+// Single-file torrents are written to destPath, multi-file torrents
+// are written in a directory named after the torrent inside destPath.
+func (torrent *TorrentFile) FileEntries(destPath string) []FileEntry {
+	if !torrent.Info.IsMultiFile() {
+		return []FileEntry{{Path: destPath, Length: torrent.Info.Length}}
+	}
+
+	entries := []FileEntry{}
+	offset := 0
+	for _, file := range torrent.Info.Files {
+		path := filepath.Join(append([]string{destPath, torrent.Info.Name}, file.Path...)...)
+		entries = append(entries, FileEntry{Path: path, Length: file.Length, Offset: offset})
+		offset += file.Length
+	}
+	return entries
+}
+
+// Hashes the bencoded info dictionary
+func hashInfo(encodedInfo []byte) []byte {
 	sha := sha1.New()
-	sha.Write([]byte(encodedInfo))
-	infoHash := sha.Sum(nil)
-	return infoHash, nil
+	sha.Write(encodedInfo)
+	return sha.Sum(nil)
+}
+
+// Returns the number of pieces in the torrent
+func (torrent *TorrentFile) NumPieces() int {
+	return len(torrent.Info.Pieces)
+}
+
+// Returns the length of a piece, the last piece may be shorter than the others
+func (torrent *TorrentFile) PieceSize(pieceIndex int) int {
+	begin := pieceIndex * torrent.Info.PieceLen
+	end := begin + torrent.Info.PieceLen
+	if end > torrent.Info.Length {
+		end = torrent.Info.Length
+	}
+	return end - begin
+}
+
+// Returns the number of bytes of the pieces missing from have
+func (torrent *TorrentFile) BytesLeft(have Bitmap) int {
+	left := 0
+	for i := 0; i < torrent.NumPieces(); i++ {
+		if !have.Has(i) {
+			left += torrent.PieceSize(i)
+		}
+	}
+	return left
+}
+
+// Checks the data of a piece against its SHA-1 hash from the info dictionary
+func (torrent *TorrentFile) VerifyPiece(pieceIndex int, data []byte) bool {
+	if pieceIndex < 0 || pieceIndex >= len(torrent.Info.Pieces) {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return string(hash[:]) == torrent.Info.Pieces[pieceIndex]
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns an info dictionary of a multi-file torrent with one file at the given path
+func multiFileInfo(name string, path ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         name,
+		"piece length": 16,
+		"pieces":       strings.Repeat("\x00", 20),
+		"files": []interface{}{
+			map[string]interface{}{"length": 10, "path": path},
+		},
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+	info, err := parseInfo(multiFileInfo("dir", "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "dir" || info.Length != 10 || len(info.Files) != 1 || strings.Join(info.Files[0].Path, "/") != "sub/file" {
+		t.Errorf("parseInfo = %+v", info)
+	}
+}
+
+func TestParseInfoUnsafePaths(t *testing.T) {
+	tests := []struct {
+		name string
+		info map[string]interface{}
+	}{
+		{"parent directory in path", multiFileInfo("dir", "..", "file")},
+		{"current directory in path", multiFileInfo("dir", ".")},
+		{"empty path component", multiFileInfo("dir", "")},
+		{"separator in path", multiFileInfo("dir", "a/../../file")},
+		{"backslash in path", multiFileInfo("dir", "..\\file")},
+		{"nul in path", multiFileInfo("dir", "file\x00")},
+		{"parent directory as name", multiFileInfo("..", "file")},
+		{"separator in name", multiFileInfo("../x", "file")},
+		{"empty name", multiFileInfo("", "file")},
+	}
+
+	for _, test := range tests {
+		_, err := parseInfo(test.info)
+		if err == nil {
+			t.Errorf("%s: parseInfo succeeded, want an error", test.name)
+		}
+	}
+}
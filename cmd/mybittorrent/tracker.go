@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Port we listen on for incoming peer connections
+const ListenPort = 6881
+
+// Port we announce to the trackers, updated when we listen on another port
+var announcePort = ListenPort
+
+const (
+	// Peers asked from a tracker in every announce
+	DefaultNumWant = 50
+
+	// Time allowed for an HTTP tracker to answer
+	TrackerHTTPTimeout = 15 * time.Second
+
+	// Largest HTTP tracker response we read
+	MaxTrackerResponseLength = 1024 * 1024
+)
+
+// HTTP client used for the trackers
+var trackerHTTPClient = &http.Client{Timeout: TrackerHTTPTimeout}
+
+// TrackerFailure is the failure reason a tracker gives when it refuses an announce
+type TrackerFailure struct {
+	Reason string
+}
+
+func (failure *TrackerFailure) Error() string {
+	return "Tracker failure: " + failure.Reason
+}
+
+// TrackerWarning is the warning message a tracker gives with a successful announce.
+// It is returned as the error next to the peers of the announce.
+type TrackerWarning struct {
+	Tracker string // announce URL of the tracker
+	Message string
+}
+
+func (warning *TrackerWarning) Error() string {
+	return fmt.Sprintf("Tracker %s warning: %s", warning.Tracker, warning.Message)
+}
+
+// Key sent in announces, it identifies us if our IP address changes
+var trackerKey = randomUint32()
+
+// AnnounceEvent is the event reported to a tracker with an announce.
+// The values are the event codes of UDP trackers.
+type AnnounceEvent int
+
+const (
+	EventNone AnnounceEvent = iota // regular announce
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// Returns the name of the event in HTTP announces
+func (event AnnounceEvent) String() string {
+	switch event {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// announceRequest is what we report to a tracker
+type announceRequest struct {
+	event      AnnounceEvent
+	uploaded   int64
+	downloaded int64
+	left       int64
+	numWant    int
+	background bool // nobody waits for the answer, UDP trackers get the full retransmission schedule
+}
+
+// announceResponse is what a tracker answers to an announce
+type announceResponse struct {
+	peers       []Peer
+	interval    time.Duration // time to wait before the next announce, 0 when not given
+	minInterval time.Duration // time we must wait at least before announcing again
+	trackerId   string        // sent back in the next announces to the tracker
+	warning     *TrackerWarning
+}
+
+// Given a torrent file, we collect the Announce URLs together with the InfoHash
+// and we enable the client to request peers from the tracker servers.
+// A warning of a tracker is returned as a *TrackerWarning error next to the peers.
+// The tiers of trackers are announced to at the same time. Within a tier the
+// trackers are tried one after another as described in BEP 12, and the first
+// one that works is moved to the front of its tier. The peers of every tier are merged.
+func RequestPeers(torrent *TorrentFile) ([]Peer, error) {
+	tiers := torrent.trackerTiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("Torrent has no trackers")
+	}
+
+	request := announceRequest{left: int64(announceLeft(torrent)), numWant: DefaultNumWant}
+	responses, errs := announceTiers(tiers, func(tier []string) (*announceResponse, error) {
+		return announceTier(torrent, tier, request)
+	})
+	return mergeResponses(responses, errs)
+}
+
+// Sends the stopped event to every tier, so that the trackers forget us after
+// an announce made only to list the peers. Waits a little for the trackers to answer.
+func announceStopped(torrent *TorrentFile) {
+	tiers := torrent.trackerTiers()
+	request := announceRequest{event: EventStopped, left: int64(announceLeft(torrent))}
+
+	done := make(chan struct{})
+	go func() {
+		announceTiers(tiers, func(tier []string) (*announceResponse, error) {
+			return announceTier(torrent, tier, request)
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(StoppedAnnounceTimeout):
+	}
+}
+
+// Merges the peers the tiers gave. Without peers the last error is returned.
+// With peers, the first warning of a tracker is returned as a *TrackerWarning next to them.
+func mergeResponses(responses []*announceResponse, errs []error) ([]Peer, error) {
+	peers := []Peer{}
+	var lastErr error
+	var warning *TrackerWarning
+	for i, response := range responses {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		peers = mergePeers(peers, response.peers)
+		if warning == nil {
+			warning = response.warning
+		}
+	}
+
+	if len(peers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if warning != nil {
+		return peers, warning
+	}
+	return peers, nil
+}
+
+// Announces to every tier at the same time, so that a slow tier does not hold back the others.
+// Returns the answers and errors in the order of the tiers.
+func announceTiers(tiers [][]string, announce func(tier []string) (*announceResponse, error)) ([]*announceResponse, []error) {
+	responses := make([]*announceResponse, len(tiers))
+	errs := make([]error, len(tiers))
+	var wg sync.WaitGroup
+	for i, tier := range tiers {
+		i, tier := i, tier
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = announce(tier)
+		}()
+	}
+	wg.Wait()
+	return responses, errs
+}
+
+// Appends the peers that are not in the list yet
+func mergePeers(peers []Peer, more []Peer) []Peer {
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		seen[peer.String()] = true
+	}
+	for _, peer := range more {
+		if !seen[peer.String()] {
+			seen[peer.String()] = true
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// Announces to the trackers of a tier until one of them answers.
+// The tracker that answered is promoted to the front of the tier.
+func announceTier(torrent *TorrentFile, tier []string, request announceRequest) (*announceResponse, error) {
+	torrent.trackersMu.Lock()
+	trackers := append([]string{}, tier...)
+	torrent.trackersMu.Unlock()
+
+	var lastErr error
+	for _, tracker := range trackers {
+		response, err := announceTracker(tracker, torrent, request)
+		if err != nil {
+			fmt.Printf("Tracker %s: %v\n", tracker, err)
+			lastErr = err
+			continue
+		}
+
+		promoteTracker(torrent, tier, tracker)
+		return response, nil
+	}
+
+	return nil, lastErr
+}
+
+// Moves a working tracker to the front of its tier
+func promoteTracker(torrent *TorrentFile, tier []string, tracker string) {
+	torrent.trackersMu.Lock()
+	defer torrent.trackersMu.Unlock()
+
+	for i, url := range tier {
+		if url == tracker {
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = tracker
+			return
+		}
+	}
+}
+
+// Announces to a single tracker using the protocol of its URL
+func announceTracker(announceUrl string, torrent *TorrentFile, request announceRequest) (*announceResponse, error) {
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedUrl.Scheme {
+	case "http", "https":
+		return announceHTTP(announceUrl, torrent, request)
+	case "udp":
+		return announceUDP(parsedUrl.Host, torrent, request)
+	default:
+		return nil, fmt.Errorf("Unsupported tracker protocol %s", parsedUrl.Scheme)
+	}
+}
+
+// Returns the number of bytes left to download reported to the trackers
+func announceLeft(torrent *TorrentFile) int {
+	// The length is unknown until the metadata of a magnet link is fetched
+	if torrent.NumPieces() == 0 {
+		return 1
+	}
+	return torrent.Info.Length
+}
+
+// Announces to an HTTP tracker.
+// The tracker id it gives is remembered and sent in the next announces to it.
+func announceHTTP(announceUrl string, torrent *TorrentFile, request announceRequest) (*announceResponse, error) {
+
+	// Get the local peer ID
+	localPeerId, err := getLocalId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Do HTTP GET request to the tracker
+	req, err := http.NewRequest("GET", announceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the query parameters
+	q := req.URL.Query()
+	q.Add("info_hash", string(torrent.InfoHash))
+	q.Add("peer_id", localPeerId)
+	q.Add("port", fmt.Sprint(announcePort))
+	q.Add("uploaded", fmt.Sprint(request.uploaded))
+	q.Add("downloaded", fmt.Sprint(request.downloaded))
+	q.Add("left", fmt.Sprint(request.left))
+	q.Add("compact", "1")
+	q.Add("numwant", fmt.Sprint(request.numWant))
+	q.Add("key", fmt.Sprintf("%08x", trackerKey))
+	if request.event != EventNone {
+		q.Add("event", request.event.String())
+	}
+	if trackerId := torrent.trackerId(announceUrl); trackerId != "" {
+		q.Add("trackerid", trackerId)
+	}
+	if ip := localIPv6(); ip.IsValid() {
+		q.Add("ipv6", ip.String())
+	}
+	req.URL.RawQuery = q.Encode()
+
+	dict, err := getTrackerDict(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the peers, either compact or as a list of dictionaries.
+	// The IPv6 peers come in peers6 (BEP 7).
+	response := &announceResponse{}
+	switch peers := dict["peers"].(type) {
+	case string:
+		response.peers = parseCompactPeers([]byte(peers), net.IPv4len)
+	case []interface{}:
+		response.peers = parseDictPeers(peers)
+	}
+	responsePeers6, _ := dict["peers6"].(string)
+	response.peers = append(response.peers, parseCompactPeers([]byte(responsePeers6), net.IPv6len)...)
+
+	if message, ok := dict["warning message"].(string); ok {
+		response.warning = &TrackerWarning{Tracker: announceUrl, Message: message}
+	}
+
+	if interval, ok := dict["interval"].(int); ok && interval > 0 {
+		response.interval = time.Duration(interval) * time.Second
+	}
+	if minInterval, ok := dict["min interval"].(int); ok && minInterval > 0 {
+		response.minInterval = time.Duration(minInterval) * time.Second
+	}
+	if trackerId, ok := dict["tracker id"].(string); ok && trackerId != "" {
+		response.trackerId = trackerId
+		torrent.setTrackerId(announceUrl, trackerId)
+	}
+	return response, nil
+}
+
+// Sends a request to an HTTP tracker and decodes the dictionary it answers.
+// The failure reason of the tracker is returned as a TrackerFailure.
+func getTrackerDict(req *http.Request) (map[string]interface{}, error) {
+	resp, err := trackerHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read the response
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, MaxTrackerResponseLength))
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the response. Trackers may explain an error status with a failure reason.
+	decoded, _, err := decodeBencode(string(responseBody))
+	dict, ok := decoded.(map[string]interface{})
+	if err == nil && ok {
+		if reason, ok := dict["failure reason"].(string); ok {
+			return nil, &TrackerFailure{Reason: reason}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker returned HTTP status %s", resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Tracker response is not a dictionary")
+	}
+	return dict, nil
+}
+
+// Parses the original peer list of dictionaries with the ip and port of every peer.
+// The ip may also be a host name. The peer id is left out, the handshake gives it.
+func parseDictPeers(list []interface{}) []Peer {
+	peers := []Peer{}
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ip, _ := dict["ip"].(string)
+		port, ok := dict["port"].(int)
+		if ip == "" || !ok || port <= 0 || port > 65535 {
+			continue
+		}
+		peer, err := ParsePeerFromStr(net.JoinHostPort(ip, fmt.Sprint(port)))
+		if err != nil {
+			continue
+		}
+		peers = append(peers, *peer)
+	}
+	return peers
+}
+
+// Returns the tracker id last given by a tracker
+func (torrent *TorrentFile) trackerId(announceUrl string) string {
+	torrent.trackersMu.Lock()
+	defer torrent.trackersMu.Unlock()
+	return torrent.trackerIds[announceUrl]
+}
+
+// Remembers the tracker id given by a tracker
+func (torrent *TorrentFile) setTrackerId(announceUrl string, trackerId string) {
+	torrent.trackersMu.Lock()
+	defer torrent.trackersMu.Unlock()
+	if torrent.trackerIds == nil {
+		torrent.trackerIds = make(map[string]string)
+	}
+	torrent.trackerIds[announceUrl] = trackerId
+}
+
+// Returns a global IPv6 address of this host, sent to the trackers so that
+// they also give our address to IPv6 peers. Returns an invalid address when there is none.
+func localIPv6() netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if ok && ip.Is6() && !ip.Is4In6() && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+	return netip.Addr{}
+}
+
+// Parses a compact peer list, where every peer is an IP address
+// of ipLen bytes followed by a 2 bytes port in network order.
+func parseCompactPeers(data []byte, ipLen int) []Peer {
+	entryLen := ipLen + 2
+	peers := make([]Peer, 0, len(data)/entryLen)
+	for i := 0; i+entryLen <= len(data); i += entryLen {
+		ip := net.IP(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+entryLen])
+		peers = append(peers, newPeer(ip, int(port)))
+	}
+	return peers
+}
+
+// Returns a random number for transaction IDs and keys
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Time between announces when a tracker does not give an interval
+	DefaultAnnounceInterval = 30 * time.Minute
+
+	// Shortest interval between announces to a tier, whatever the tracker says
+	MinAnnounceInterval = time.Minute
+
+	// Time before announcing again to a tier whose trackers all failed, doubled on every failure
+	AnnounceRetryInterval    = time.Minute
+	MaxAnnounceRetryInterval = 30 * time.Minute
+
+	// Longest wait for the trackers to acknowledge the stopped event on shutdown
+	StoppedAnnounceTimeout = 5 * time.Second
+)
+
+// TransferStats counts the data of a torrent exchanged with all peers
+type TransferStats struct {
+	mu         sync.Mutex
+	uploaded   int64
+	downloaded int64
+	left       int64
+}
+
+// Records a block received from a peer
+func (stats *TransferStats) AddDownloaded(length int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.downloaded += int64(length)
+}
+
+// Records a block sent to a peer
+func (stats *TransferStats) AddUploaded(length int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.uploaded += int64(length)
+}
+
+// Sets the number of bytes we still have to download
+func (stats *TransferStats) SetLeft(left int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.left = int64(left)
+}
+
+// Records a verified piece of the given size
+func (stats *TransferStats) PieceCompleted(size int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.left -= int64(size)
+	if stats.left < 0 {
+		stats.left = 0
+	}
+}
+
+// Returns the bytes uploaded, downloaded and left
+func (stats *TransferStats) Snapshot() (int64, int64, int64) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.uploaded, stats.downloaded, stats.left
+}
+
+// TrackerSession announces a torrent to its trackers for as long as we download or seed it.
+// Every tier is announced on its own schedule: started first, then again after the
+// interval its tracker gave, completed once the download finishes and stopped on shutdown.
+// The counters come from the Transfer stats of the torrent.
+type TrackerSession struct {
+	torrent *TorrentFile
+	onPeers func([]Peer) // called with the peers of every announce after the first one
+
+	completed     chan struct{}
+	completedOnce sync.Once
+	stop          chan struct{}
+	stopOnce      sync.Once
+	wg            sync.WaitGroup
+}
+
+// Creates a tracker session for a torrent
+func NewTrackerSession(torrent *TorrentFile) *TrackerSession {
+	return &TrackerSession{
+		torrent:   torrent,
+		completed: make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Sends the started event to every tier at the same time and returns the peers they gave,
+// with a *TrackerWarning error when a tracker gave a warning along with them.
+// The tiers are then announced again in the background, passing the new peers to onPeers.
+func (session *TrackerSession) Start(onPeers func([]Peer)) ([]Peer, error) {
+	tiers := session.torrent.trackerTiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("Torrent has no trackers")
+	}
+	session.onPeers = onPeers
+
+	responses, errs := announceTiers(tiers, func(tier []string) (*announceResponse, error) {
+		return session.announce(tier, EventStarted)
+	})
+
+	for i, tier := range tiers {
+		session.wg.Add(1)
+		go session.runTier(tier, responses[i])
+	}
+	return mergeResponses(responses, errs)
+}
+
+// Tells the trackers the download finished
+func (session *TrackerSession) Completed() {
+	session.completedOnce.Do(func() {
+		close(session.completed)
+	})
+}
+
+// Tells the trackers we stop and waits a little for them to acknowledge it
+func (session *TrackerSession) Stop() {
+	session.stopOnce.Do(func() {
+		close(session.stop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		session.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(StoppedAnnounceTimeout):
+	}
+}
+
+// Announces an event to a tier with the current counters.
+// The started event is waited for, the other announces run in the background.
+func (session *TrackerSession) announce(tier []string, event AnnounceEvent) (*announceResponse, error) {
+	uploaded, downloaded, left := session.torrent.Transfer.Snapshot()
+	request := announceRequest{
+		event:      event,
+		uploaded:   uploaded,
+		downloaded: downloaded,
+		left:       left,
+		numWant:    DefaultNumWant,
+		background: event != EventStarted && event != EventStopped,
+	}
+	if event == EventStopped {
+		request.numWant = 0
+	}
+	return announceTier(session.torrent, tier, request)
+}
+
+// Announces to a tier until the session stops.
+// response is the answer to the started event, nil when it failed.
+// Events that fail are sent again at the next announce.
+func (session *TrackerSession) runTier(tier []string, response *announceResponse) {
+	defer session.wg.Done()
+
+	started := response != nil
+	pending := EventNone
+	if !started {
+		pending = EventStarted
+	}
+	failures := 0
+	if !started {
+		failures = 1
+	}
+	completed := session.completed
+
+	for {
+		timer := time.NewTimer(nextAnnounce(response, failures))
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+
+			// A tier that never got the started event learns about it with left=0
+			if !started {
+				continue
+			}
+			pending = EventCompleted
+		case <-session.stop:
+			timer.Stop()
+
+			// The download may have finished right before the shutdown
+			select {
+			case <-completed:
+				if started {
+					session.announce(tier, EventCompleted)
+				}
+			default:
+			}
+			if started {
+				session.announce(tier, EventStopped)
+			}
+			return
+		}
+
+		result, err := session.announce(tier, pending)
+		if err != nil {
+			failures++
+			continue
+		}
+		response = result
+		failures = 0
+		started = true
+		pending = EventNone
+		if response.warning != nil {
+			fmt.Println(response.warning)
+		}
+		if session.onPeers != nil && len(response.peers) > 0 {
+			session.onPeers(response.peers)
+		}
+	}
+}
+
+// Returns the time to wait before the next announce: the interval the tracker gave
+// after a success, or a backoff after failures
+func nextAnnounce(response *announceResponse, failures int) time.Duration {
+	if failures > 0 {
+		wait := AnnounceRetryInterval << uint(failures-1)
+		if wait > MaxAnnounceRetryInterval || wait <= 0 {
+			wait = MaxAnnounceRetryInterval
+		}
+		return wait
+	}
+
+	wait := response.interval
+	if wait == 0 {
+		wait = DefaultAnnounceInterval
+	}
+	if wait < response.minInterval {
+		wait = response.minInterval
+	}
+	if wait < MinAnnounceInterval {
+		wait = MinAnnounceInterval
+	}
+	return wait
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Starts an HTTP tracker answering every announce with the given dictionary
+func testTracker(t *testing.T, dict map[string]interface{}) string {
+	encoded, err := encodeBencode(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(encoded))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func TestRequestPeersWarningsAndFailures(t *testing.T) {
+	peers := map[string]interface{}{"interval": 1800, "peers": "\x0a\x00\x00\x01\x1a\xe1"}
+	warning := map[string]interface{}{"interval": 1800, "peers": "\x0a\x00\x00\x02\x1a\xe1", "warning message": "slow down"}
+	failure := map[string]interface{}{"failure reason": "unregistered torrent"}
+
+	tests := []struct {
+		name    string
+		tiers   []map[string]interface{}
+		peers   int
+		warning bool
+		failure bool
+	}{
+		{"peers", []map[string]interface{}{peers}, 1, false, false},
+		{"warning", []map[string]interface{}{warning}, 1, true, false},
+		{"warning with another tier", []map[string]interface{}{peers, warning}, 2, true, false},
+		{"failure", []map[string]interface{}{failure}, 0, false, true},
+		{"failure with another tier", []map[string]interface{}{failure, peers}, 1, false, false},
+	}
+
+	for _, test := range tests {
+		torrent := &TorrentFile{InfoHash: make([]byte, 20)}
+		for _, dict := range test.tiers {
+			torrent.AnnounceList = append(torrent.AnnounceList, []string{testTracker(t, dict)})
+		}
+
+		got, err := RequestPeers(torrent)
+		if len(got) != test.peers {
+			t.Errorf("%s: got peers %v, want %d", test.name, got, test.peers)
+		}
+		var trackerWarning *TrackerWarning
+		if errors.As(err, &trackerWarning) != test.warning {
+			t.Errorf("%s: got error %v, want a warning: %v", test.name, err, test.warning)
+		} else if test.warning && trackerWarning.Message != "slow down" {
+			t.Errorf("%s: got warning %q, want %q", test.name, trackerWarning.Message, "slow down")
+		}
+		var trackerFailure *TrackerFailure
+		if errors.As(err, &trackerFailure) != test.failure {
+			t.Errorf("%s: got error %v, want a failure: %v", test.name, err, test.failure)
+		}
+	}
+}
+
+func TestAnnounceStopped(t *testing.T) {
+	events := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event") + " numwant=" + r.URL.Query().Get("numwant")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	torrent := &TorrentFile{InfoHash: make([]byte, 20), Announce: server.URL + "/announce"}
+	announceStopped(torrent)
+	select {
+	case event := <-events:
+		if event != "stopped numwant=0" {
+			t.Errorf("tracker got %q, want the stopped event without peers wanted", event)
+		}
+	default:
+		t.Errorf("tracker got no announce")
+	}
+}
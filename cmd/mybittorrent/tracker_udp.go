@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolId = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// A request is retransmitted after 15 * 2^n seconds, with n up to 8
+	UDPTrackerBaseTimeout   = 15 * time.Second
+	UDPTrackerMaxRetransmit = 8
+
+	// Requests we wait for stop at n = 2, so that an unreachable tracker
+	// holds back the next tracker or the DHT for less than two minutes
+	UDPTrackerQuickRetransmit = 2
+
+	// How long a connection ID can be used after it was obtained
+	UDPConnectionIdLifetime = time.Minute
+)
+
+// udpConnectionId is a connection ID obtained from a tracker
+type udpConnectionId struct {
+	id       uint64
+	obtained time.Time
+}
+
+// Connection IDs cached by tracker address
+var udpConnectionIds = struct {
+	sync.Mutex
+	ids map[string]udpConnectionId
+}{ids: make(map[string]udpConnectionId)}
+
+// udpTracker is a socket connected to a UDP tracker
+type udpTracker struct {
+	host          string
+	conn          *net.UDPConn
+	ipv6          bool // peers are returned as IPv6 addresses when talking over IPv6
+	maxRetransmit int  // last n of the retransmission schedule
+}
+
+// Opens a socket to a UDP tracker. Requests give up after the quick retransmission schedule.
+func dialUDPTracker(host string) (*udpTracker, error) {
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{
+		host:          host,
+		conn:          conn,
+		ipv6:          addr.IP.To4() == nil,
+		maxRetransmit: UDPTrackerQuickRetransmit,
+	}, nil
+}
+
+// Sends a request and waits for its response, retransmitting it following the
+// BEP 15 backoff schedule up to maxRetransmit. A connection ID is obtained first
+// when needed, as part of the same attempt.
+// Returns the response without the action and transaction ID.
+func (tracker *udpTracker) transact(action uint32, payload []byte) ([]byte, error) {
+	for n := 0; n <= tracker.maxRetransmit; n++ {
+		// Every request but connect needs a valid connection ID
+		connectionId := uint64(udpProtocolId)
+		if action != udpActionConnect {
+			id, ok := tracker.cachedConnectionId()
+			if !ok {
+				response, err := tracker.exchange(udpProtocolId, udpActionConnect, nil, n)
+				if err != nil {
+					return nil, err
+				}
+				if response == nil {
+					continue
+				}
+				if len(response) < 8 {
+					return nil, fmt.Errorf("Invalid connect response from %s", tracker.host)
+				}
+				id = binary.BigEndian.Uint64(response[0:8])
+				tracker.storeConnectionId(id)
+			}
+			connectionId = id
+		}
+
+		response, err := tracker.exchange(connectionId, action, payload, n)
+		if err != nil {
+			return nil, err
+		}
+		if response != nil {
+			return response, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Tracker %s did not respond", tracker.host)
+}
+
+// Sends a request once and waits for the response with the same transaction ID
+// for the timeout of attempt n. Returns nil without an error when it times out.
+func (tracker *udpTracker) exchange(connectionId uint64, action uint32, payload []byte, n int) ([]byte, error) {
+	// Header: connection ID (8 bytes), action (4 bytes), transaction ID (4 bytes)
+	transactionId := randomUint32()
+	request := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint64(request[0:8], connectionId)
+	binary.BigEndian.PutUint32(request[8:12], action)
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+	request = append(request, payload...)
+
+	_, err := tracker.conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the matching response, ignoring stale ones
+	response := make([]byte, 2048)
+	tracker.conn.SetReadDeadline(time.Now().Add(UDPTrackerBaseTimeout << uint(n)))
+	for {
+		length, err := tracker.conn.Read(response)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if length < 8 || binary.BigEndian.Uint32(response[4:8]) != transactionId {
+			continue
+		}
+
+		responseAction := binary.BigEndian.Uint32(response[0:4])
+		if responseAction == udpActionError {
+			tracker.forgetConnectionId()
+			return nil, &TrackerFailure{Reason: string(response[8:length])}
+		}
+		if responseAction != action {
+			return nil, fmt.Errorf("Expected tracker action %d, got=%d", action, responseAction)
+		}
+		return append([]byte{}, response[8:length]...), nil
+	}
+}
+
+// Returns the connection ID of the tracker if we have one that did not expire
+func (tracker *udpTracker) cachedConnectionId() (uint64, bool) {
+	udpConnectionIds.Lock()
+	defer udpConnectionIds.Unlock()
+	cached, ok := udpConnectionIds.ids[tracker.host]
+	if !ok || time.Since(cached.obtained) >= UDPConnectionIdLifetime {
+		return 0, false
+	}
+	return cached.id, true
+}
+
+// Remembers a connection ID obtained from the tracker
+func (tracker *udpTracker) storeConnectionId(id uint64) {
+	udpConnectionIds.Lock()
+	defer udpConnectionIds.Unlock()
+	udpConnectionIds.ids[tracker.host] = udpConnectionId{id: id, obtained: time.Now()}
+}
+
+// Drops the cached connection ID so that the next request obtains a new one
+func (tracker *udpTracker) forgetConnectionId() {
+	udpConnectionIds.Lock()
+	delete(udpConnectionIds.ids, tracker.host)
+	udpConnectionIds.Unlock()
+}
+
+// Announces to a UDP tracker
+func announceUDP(host string, torrent *TorrentFile, request announceRequest) (*announceResponse, error) {
+	localPeerId, err := getLocalId()
+	if err != nil {
+		return nil, err
+	}
+
+	tracker, err := dialUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.conn.Close()
+
+	// Nobody waits for the announces of a session in the background
+	if request.background {
+		tracker.maxRetransmit = UDPTrackerMaxRetransmit
+	}
+
+	// Announce request after the header
+	// Info Hash: 20 bytes, Peer ID: 20 bytes
+	// Downloaded, Left, Uploaded: 8 bytes each
+	// Event, IP address, Key, Num Want: 4 bytes each
+	// Port: 2 bytes
+	payload := make([]byte, 82)
+	copy(payload[0:20], torrent.InfoHash)
+	copy(payload[20:40], localPeerId)
+	binary.BigEndian.PutUint64(payload[40:48], uint64(request.downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(request.left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(request.uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], uint32(request.event))
+	binary.BigEndian.PutUint32(payload[68:72], 0)
+	binary.BigEndian.PutUint32(payload[72:76], trackerKey)
+	binary.BigEndian.PutUint32(payload[76:80], uint32(request.numWant))
+	binary.BigEndian.PutUint16(payload[80:82], uint16(announcePort))
+
+	response, err := tracker.transact(udpActionAnnounce, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Announce response: interval, leechers, seeders (4 bytes each) then the peers
+	if len(response) < 12 {
+		return nil, fmt.Errorf("Invalid announce response from %s", host)
+	}
+	ipLen := net.IPv4len
+	if tracker.ipv6 {
+		ipLen = net.IPv6len
+	}
+	return &announceResponse{
+		peers:    parseCompactPeers(response[12:], ipLen),
+		interval: time.Duration(binary.BigEndian.Uint32(response[0:4])) * time.Second,
+	}, nil
+}
@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet types of the uTP protocol (BEP 29)
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const (
+	utpVersion = 1
+
+	// Length of the packet header, without extensions
+	utpHeaderLen = 20
+
+	// Extension carrying the selective acks
+	utpSelectiveAck = 1
+
+	// Largest payload sent in a packet, small enough to avoid IP fragmentation
+	utpPayloadSize = 1200
+
+	// Queuing delay LEDBAT aims for, in microseconds
+	utpTargetDelay = 100000
+
+	// Most the congestion window grows in a round trip
+	utpMaxWindowIncrease = 3000
+
+	// Bounds of the congestion window
+	utpMinWindow = utpPayloadSize
+	utpMaxWindow = 1024 * 1024
+
+	// Data accepted from the peer before it is read
+	utpReceiveBuffer = 1024 * 1024
+
+	// Data written but not yet sent before Write blocks
+	utpSendBuffer = 64 * 1024
+
+	// Most packets buffered past a missing one
+	utpMaxOutOfOrder = 1024
+
+	// Retransmission timeout before the first round trip is measured, and its lower bound
+	utpInitialTimeout = time.Second
+	utpMinTimeout     = 500 * time.Millisecond
+
+	// Consecutive retransmission timeouts after which the connection is dropped
+	utpMaxTimeouts = 6
+
+	// A packet is sent when nothing was sent for this long, to keep NAT mappings open
+	utpKeepAliveInterval = 29 * time.Second
+
+	// Time given to the peer to acknowledge our FIN
+	utpCloseTimeout = 10 * time.Second
+
+	// How often timeouts are checked
+	utpTickInterval = 50 * time.Millisecond
+
+	// Incoming connections waiting to be accepted
+	utpAcceptBacklog = 16
+)
+
+// Connection states
+const (
+	utpSynSent = iota
+	utpConnected
+	utpClosed
+)
+
+// TransportPolicy tells which transports are used to connect to peers
+type TransportPolicy int
+
+const (
+	// Connect with TCP, then with uTP when TCP fails
+	TransportPreferTCP TransportPolicy = iota
+
+	// Connect with uTP, then with TCP when uTP fails
+	TransportPreferUTP
+
+	// Only connect with TCP
+	TransportTCP
+
+	// Only connect with uTP
+	TransportUTP
+)
+
+// Policy used for outgoing peer connections, set from the command line
+var transportPolicy = TransportPreferTCP
+
+// Parses a transport policy given on the command line
+func ParseTransportPolicy(value string) (TransportPolicy, error) {
+	switch value {
+	case "prefer-tcp":
+		return TransportPreferTCP, nil
+	case "prefer-utp":
+		return TransportPreferUTP, nil
+	case "tcp":
+		return TransportTCP, nil
+	case "utp":
+		return TransportUTP, nil
+	}
+	return 0, fmt.Errorf("Unknown transport %q, expected prefer-tcp, prefer-utp, tcp or utp", value)
+}
+
+// utpPacket is a decoded uTP packet
+type utpPacket struct {
+	kind          int
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	window        uint32
+	seq           uint16
+	ack           uint16
+	sack          []byte // selective ack bitmask, nil when absent
+	payload       []byte
+}
+
+// Encodes a packet with its extensions
+func (packet *utpPacket) encode() []byte {
+	extension := byte(0)
+	if packet.sack != nil {
+		extension = utpSelectiveAck
+	}
+
+	buf := make([]byte, utpHeaderLen, utpHeaderLen+2+len(packet.sack)+len(packet.payload))
+	buf[0] = byte(packet.kind<<4 | utpVersion)
+	buf[1] = extension
+	binary.BigEndian.PutUint16(buf[2:4], packet.connId)
+	binary.BigEndian.PutUint32(buf[4:8], packet.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], packet.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], packet.window)
+	binary.BigEndian.PutUint16(buf[16:18], packet.seq)
+	binary.BigEndian.PutUint16(buf[18:20], packet.ack)
+	if packet.sack != nil {
+		buf = append(buf, 0, byte(len(packet.sack)))
+		buf = append(buf, packet.sack...)
+	}
+	return append(buf, packet.payload...)
+}
+
+// Decodes a packet, skipping the extensions we do not know
+func decodeUtpPacket(data []byte) (*utpPacket, error) {
+	if len(data) < utpHeaderLen || data[0]&0x0f != utpVersion || data[0]>>4 > utpSyn {
+		return nil, fmt.Errorf("Invalid uTP packet")
+	}
+
+	packet := &utpPacket{
+		kind:          int(data[0] >> 4),
+		connId:        binary.BigEndian.Uint16(data[2:4]),
+		timestamp:     binary.BigEndian.Uint32(data[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(data[8:12]),
+		window:        binary.BigEndian.Uint32(data[12:16]),
+		seq:           binary.BigEndian.Uint16(data[16:18]),
+		ack:           binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	// Every extension starts with the type of the next one and its length
+	extension := data[1]
+	rest := data[utpHeaderLen:]
+	for extension != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("Invalid uTP extension")
+		}
+		if extension == utpSelectiveAck {
+			packet.sack = rest[2 : 2+int(rest[1])]
+		}
+		extension = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	packet.payload = rest
+	return packet, nil
+}
+
+// Returns the current time in microseconds, as used in the packet timestamps
+func utpTimestamp() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// Compares sequence numbers, which wrap around
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// utpKey identifies a connection on a socket by the peer address and our connection id
+type utpKey struct {
+	addr   string
+	recvId uint16
+}
+
+// utpSocket carries the uTP connections of a UDP socket
+type utpSocket struct {
+	conn      *net.UDPConn
+	accepting bool
+	accepted  chan *utpConn
+
+	mu     sync.Mutex
+	conns  map[utpKey]*utpConn
+	closed bool
+}
+
+// Socket used for outgoing uTP connections: the one of the server when it runs,
+// otherwise one on any free port, opened on first use
+var (
+	utpDialMu     sync.Mutex
+	utpDialSocket *utpSocket
+)
+
+// Opens a uTP socket on a UDP port. With accepting set, connections from peers are queued for Accept.
+func listenUTP(port int, accepting bool) (*utpSocket, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	socket := &utpSocket{
+		conn:      conn,
+		accepting: accepting,
+		accepted:  make(chan *utpConn, utpAcceptBacklog),
+		conns:     make(map[utpKey]*utpConn),
+	}
+	go socket.readLoop()
+	return socket, nil
+}
+
+// Sets the socket used for outgoing uTP connections
+func setUTPDialSocket(socket *utpSocket) {
+	utpDialMu.Lock()
+	defer utpDialMu.Unlock()
+	utpDialSocket = socket
+}
+
+// Opens a uTP connection to an address within the timeout
+func dialUTP(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	utpDialMu.Lock()
+	if utpDialSocket == nil || utpDialSocket.isClosed() {
+		utpDialSocket, err = listenUTP(0, false)
+	}
+	socket := utpDialSocket
+	utpDialMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return socket.dial(addr, timeout)
+}
+
+// Waits for the next incoming connection
+func (socket *utpSocket) Accept() (net.Conn, error) {
+	conn, ok := <-socket.accepted
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+// Closes the socket and all of its connections
+func (socket *utpSocket) Close() error {
+	return socket.conn.Close()
+}
+
+// Returns the UDP port of the socket
+func (socket *utpSocket) Port() int {
+	return socket.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Checks if the socket was closed
+func (socket *utpSocket) isClosed() bool {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	return socket.closed
+}
+
+// Sends an encoded packet to an address
+func (socket *utpSocket) send(addr *net.UDPAddr, packet *utpPacket) {
+	socket.conn.WriteToUDP(packet.encode(), addr)
+}
+
+// Registers a connection under our connection id, returns false if the id is taken
+func (socket *utpSocket) add(conn *utpConn) bool {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	key := utpKey{addr: conn.remote.String(), recvId: conn.recvId}
+	if _, ok := socket.conns[key]; ok || socket.closed {
+		return false
+	}
+	socket.conns[key] = conn
+	return true
+}
+
+// Unregisters a connection
+func (socket *utpSocket) remove(conn *utpConn) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	delete(socket.conns, utpKey{addr: conn.remote.String(), recvId: conn.recvId})
+}
+
+// Starts a connection to an address and waits for the peer to answer
+func (socket *utpSocket) dial(addr *net.UDPAddr, timeout time.Duration) (net.Conn, error) {
+	var conn *utpConn
+	for {
+		recvId := uint16(randomUint32())
+		conn = newUtpConn(socket, addr, recvId, recvId+1)
+		if socket.add(conn) {
+			break
+		}
+		if socket.isClosed() {
+			return nil, net.ErrClosed
+		}
+	}
+	go conn.run()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	// The SYN carries our connection id and is acknowledged like data
+	conn.seq = 1
+	conn.queuePacket(utpSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for conn.state == utpSynSent {
+		err := conn.wait(deadline)
+		if err != nil {
+			conn.shutdown(fmt.Errorf("uTP connection to %s timed out", addr))
+			return nil, conn.err
+		}
+	}
+	if conn.err != nil {
+		return nil, conn.err
+	}
+	return conn, nil
+}
+
+// Reads packets and hands them to their connection until the socket is closed
+func (socket *utpSocket) readLoop() {
+	defer func() {
+		socket.mu.Lock()
+		socket.closed = true
+		conns := []*utpConn{}
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mu.Unlock()
+		close(socket.accepted)
+
+		for _, conn := range conns {
+			conn.mu.Lock()
+			conn.shutdown(net.ErrClosed)
+			conn.mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := socket.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		packet, err := decodeUtpPacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+
+		// A SYN carries the id the peer receives with, we receive with the next one
+		recvId := packet.connId
+		if packet.kind == utpSyn {
+			recvId++
+		}
+		socket.mu.Lock()
+		conn, ok := socket.conns[utpKey{addr: addr.String(), recvId: recvId}]
+		socket.mu.Unlock()
+
+		switch {
+		case ok:
+			conn.handlePacket(packet)
+		case packet.kind == utpSyn:
+			socket.accept(addr, packet)
+		case packet.kind != utpReset:
+			// Tell the peer the connection does not exist
+			socket.send(addr, &utpPacket{kind: utpReset, connId: packet.connId, timestamp: utpTimestamp(), ack: packet.seq})
+		}
+	}
+}
+
+// Creates a connection for the SYN of a peer and queues it for Accept
+func (socket *utpSocket) accept(addr *net.UDPAddr, syn *utpPacket) {
+	reset := &utpPacket{kind: utpReset, connId: syn.connId, timestamp: utpTimestamp(), ack: syn.seq}
+	if !socket.accepting {
+		socket.send(addr, reset)
+		return
+	}
+
+	conn := newUtpConn(socket, addr, syn.connId+1, syn.connId)
+	conn.state = utpConnected
+	conn.seq = uint16(randomUint32())
+	conn.ack = syn.seq
+	conn.peerWindow = int(syn.window)
+	if !socket.add(conn) {
+		return
+	}
+
+	select {
+	case socket.accepted <- conn:
+	default:
+		socket.remove(conn)
+		socket.send(addr, reset)
+		return
+	}
+
+	go conn.run()
+	conn.mu.Lock()
+	conn.sendState()
+	conn.mu.Unlock()
+}
+
+// utpOutgoing is a packet sent and not acknowledged yet
+type utpOutgoing struct {
+	kind        int
+	seq         uint16
+	payload     []byte
+	sentAt      time.Time
+	sends       int
+	inFlight    bool // counted in the bytes in flight
+	needsResend bool
+	fastResent  bool
+}
+
+// utpConn is a uTP connection, usable wherever a TCP connection is.
+// Data is split in packets sent within a congestion window controlled by LEDBAT,
+// which backs off when the queuing delay measured by the peer grows,
+// so that bulk transfers yield to other traffic.
+type utpConn struct {
+	socket *utpSocket
+	remote *net.UDPAddr
+	recvId uint16 // connection id of the packets we receive
+	sendId uint16 // connection id of the packets we send
+	done   chan struct{}
+
+	mu      sync.Mutex
+	signal  chan struct{} // closed and replaced on every state change
+	state   int
+	err     error // why the connection ended
+	closing bool
+	closeAt time.Time
+
+	// Sending
+	seq         uint16 // sequence number of the next packet
+	lastAck     uint16 // last ack received
+	dupAcks     int
+	unacked     []*utpOutgoing
+	inFlight    int // payload bytes sent and not acknowledged
+	sendBuf     []byte
+	finSent     bool
+	maxWindow   float64 // congestion window, in bytes
+	peerWindow  int     // receive window advertised by the peer
+	lastSend    time.Time
+	timeouts    int
+	rtt, rttVar time.Duration
+	rto         time.Duration
+
+	// Delay measurements. The base delay is the lowest delay of the last two minutes.
+	delayMins    [2]uint32
+	delayMinAt   time.Time
+	replyMicro   uint32 // delay of the last packet received, echoed to the peer
+	lastReceived time.Time
+
+	// Receiving
+	ack        uint16 // last sequence number received in order
+	outOfOrder map[uint16]*utpPacket
+	readBuf    []byte
+	eof        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Creates a connection with a peer
+func newUtpConn(socket *utpSocket, remote *net.UDPAddr, recvId uint16, sendId uint16) *utpConn {
+	return &utpConn{
+		socket:       socket,
+		remote:       remote,
+		recvId:       recvId,
+		sendId:       sendId,
+		done:         make(chan struct{}),
+		signal:       make(chan struct{}),
+		state:        utpSynSent,
+		maxWindow:    utpMinWindow * 2,
+		peerWindow:   utpReceiveBuffer,
+		rto:          utpInitialTimeout,
+		outOfOrder:   make(map[uint16]*utpPacket),
+		lastSend:     time.Now(),
+		lastReceived: time.Now(),
+	}
+}
+
+// Wakes up the goroutines waiting on the connection. Called with the lock held.
+func (conn *utpConn) broadcast() {
+	close(conn.signal)
+	conn.signal = make(chan struct{})
+}
+
+// Waits for a change of the connection state until the deadline. Called with the lock held.
+func (conn *utpConn) wait(deadline time.Time) error {
+	signal := conn.signal
+	conn.mu.Unlock()
+	defer conn.mu.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-signal:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Ends the connection with an error and removes it from the socket. Called with the lock held.
+func (conn *utpConn) shutdown(err error) {
+	if conn.state == utpClosed {
+		return
+	}
+	conn.state = utpClosed
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.socket.remove(conn)
+	close(conn.done)
+	conn.broadcast()
+}
+
+// Sends a packet with the current acknowledgement state. Called with the lock held.
+func (conn *utpConn) sendPacket(kind int, seq uint16, payload []byte) {
+	connId := conn.sendId
+	if kind == utpSyn {
+		connId = conn.recvId
+	}
+
+	window := utpReceiveBuffer - len(conn.readBuf)
+	if window < 0 {
+		window = 0
+	}
+
+	packet := &utpPacket{
+		kind:          kind,
+		connId:        connId,
+		timestamp:     utpTimestamp(),
+		timestampDiff: conn.replyMicro,
+		window:        uint32(window),
+		seq:           seq,
+		ack:           conn.ack,
+		sack:          conn.selectiveAck(),
+		payload:       payload,
+	}
+	conn.socket.send(conn.remote, packet)
+	conn.lastSend = time.Now()
+}
+
+// Acknowledges the packets received. Called with the lock held.
+func (conn *utpConn) sendState() {
+	conn.sendPacket(utpState, conn.seq, nil)
+}
+
+// Returns the bitmask of the packets received past the first missing one,
+// or nil when all were received in order
+func (conn *utpConn) selectiveAck() []byte {
+	if len(conn.outOfOrder) == 0 {
+		return nil
+	}
+
+	// Bit i tells if packet ack+2+i was received
+	sack := make([]byte, 4)
+	for i := 0; i < len(sack)*8; i++ {
+		if _, ok := conn.outOfOrder[conn.ack+2+uint16(i)]; ok {
+			sack[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return sack
+}
+
+// Assigns the next sequence number to a packet and sends it. Called with the lock held.
+func (conn *utpConn) queuePacket(kind int, payload []byte) {
+	outgoing := &utpOutgoing{kind: kind, seq: conn.seq, payload: payload}
+	conn.seq++
+	conn.unacked = append(conn.unacked, outgoing)
+	conn.transmit(outgoing)
+}
+
+// Sends or resends a packet waiting for its ack. Called with the lock held.
+func (conn *utpConn) transmit(outgoing *utpOutgoing) {
+	outgoing.sentAt = time.Now()
+	outgoing.sends++
+	outgoing.needsResend = false
+	if !outgoing.inFlight {
+		outgoing.inFlight = true
+		conn.inFlight += len(outgoing.payload)
+	}
+	conn.sendPacket(outgoing.kind, outgoing.seq, outgoing.payload)
+}
+
+// Checks if a packet of the given size fits in the congestion and receive windows.
+// A packet may always be sent when nothing is in flight.
+func (conn *utpConn) windowAllows(size int) bool {
+	if conn.inFlight == 0 {
+		return true
+	}
+	window := int(conn.maxWindow)
+	if conn.peerWindow < window {
+		window = conn.peerWindow
+	}
+	return conn.inFlight+size <= window
+}
+
+// Sends lost packets again, then new data, as far as the window allows.
+// The FIN follows the last data once the connection is closing. Called with the lock held.
+func (conn *utpConn) flush() {
+	if conn.state != utpConnected {
+		return
+	}
+
+	for _, outgoing := range conn.unacked {
+		if outgoing.needsResend {
+			if !conn.windowAllows(len(outgoing.payload)) {
+				return
+			}
+			conn.transmit(outgoing)
+		}
+	}
+
+	for len(conn.sendBuf) > 0 {
+		size := len(conn.sendBuf)
+		if size > utpPayloadSize {
+			size = utpPayloadSize
+		}
+		if !conn.windowAllows(size) {
+			return
+		}
+		payload := append([]byte{}, conn.sendBuf[:size]...)
+		conn.sendBuf = conn.sendBuf[size:]
+		conn.queuePacket(utpData, payload)
+		conn.broadcast()
+	}
+
+	if conn.closing && !conn.finSent {
+		conn.finSent = true
+		conn.queuePacket(utpFin, nil)
+	}
+}
+
+// Handles a packet of the connection
+func (conn *utpConn) handlePacket(packet *utpPacket) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.state == utpClosed {
+		return
+	}
+
+	now := utpTimestamp()
+	conn.lastReceived = time.Now()
+	if packet.timestamp != 0 {
+		conn.replyMicro = now - packet.timestamp
+	}
+	conn.peerWindow = int(packet.window)
+
+	if packet.kind == utpReset {
+		conn.shutdown(fmt.Errorf("uTP connection reset by %s", conn.remote))
+		return
+	}
+	if packet.kind == utpSyn {
+		// Our answer to the SYN was lost
+		conn.sendState()
+		return
+	}
+
+	// The first packet answering our SYN tells the sequence numbers of the peer
+	if conn.state == utpSynSent {
+		conn.state = utpConnected
+		conn.ack = packet.seq - 1
+		conn.lastAck = packet.ack
+		conn.broadcast()
+	}
+
+	conn.handleAck(packet)
+
+	if packet.kind == utpData || packet.kind == utpFin {
+		conn.handleData(packet)
+	}
+
+	// Done once our FIN is acknowledged
+	if conn.finSent && len(conn.unacked) == 0 {
+		conn.shutdown(net.ErrClosed)
+		return
+	}
+	conn.flush()
+}
+
+// Removes the packets acknowledged by the peer, measures the round trip
+// and adjusts the congestion window. Called with the lock held.
+func (conn *utpConn) handleAck(packet *utpPacket) {
+	acked := make(map[uint16]bool)
+	for _, outgoing := range conn.unacked {
+		if !seqLess(packet.ack, outgoing.seq) {
+			acked[outgoing.seq] = true
+		}
+	}
+	sacked := 0
+	for i := 0; i < len(packet.sack)*8; i++ {
+		if packet.sack[i/8]&(1<<uint(i%8)) != 0 {
+			acked[packet.ack+2+uint16(i)] = true
+			sacked++
+		}
+	}
+
+	bytesAcked := 0
+	remaining := conn.unacked[:0]
+	for _, outgoing := range conn.unacked {
+		if !acked[outgoing.seq] {
+			remaining = append(remaining, outgoing)
+			continue
+		}
+		if outgoing.inFlight {
+			conn.inFlight -= len(outgoing.payload)
+		}
+		bytesAcked += len(outgoing.payload)
+
+		// Resent packets give ambiguous round trips
+		if outgoing.sends == 1 {
+			conn.updateRTT(time.Since(outgoing.sentAt))
+		}
+	}
+	progress := len(remaining) < len(conn.unacked)
+	conn.unacked = remaining
+
+	if progress {
+		conn.timeouts = 0
+		conn.dupAcks = 0
+		conn.broadcast()
+	} else if packet.kind == utpState && packet.ack == conn.lastAck && len(conn.unacked) > 0 {
+		conn.dupAcks++
+	}
+	conn.lastAck = packet.ack
+
+	// Packets past the first missing one arrived, it was most likely lost
+	if len(conn.unacked) > 0 && (conn.dupAcks >= 3 || sacked >= 3) {
+		first := conn.unacked[0]
+		if !first.fastResent {
+			first.fastResent = true
+			conn.onLoss()
+			conn.transmit(first)
+		}
+	}
+
+	if bytesAcked > 0 && packet.timestampDiff != 0 {
+		conn.updateWindow(packet.timestampDiff, bytesAcked)
+	}
+}
+
+// Updates the round trip estimate and the retransmission timeout
+func (conn *utpConn) updateRTT(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVar = sample / 2
+	} else {
+		delta := conn.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttVar += (delta - conn.rttVar) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+	conn.rto = conn.rtt + 4*conn.rttVar
+	if conn.rto < utpMinTimeout {
+		conn.rto = utpMinTimeout
+	}
+}
+
+// Grows or shrinks the congestion window from the delay the peer measured
+// on our packets, compared to the lowest delay seen recently (LEDBAT)
+func (conn *utpConn) updateWindow(delay uint32, bytesAcked int) {
+	if time.Since(conn.delayMinAt) > time.Minute {
+		conn.delayMins[1] = conn.delayMins[0]
+		conn.delayMins[0] = delay
+		conn.delayMinAt = time.Now()
+		if conn.delayMins[1] == 0 {
+			conn.delayMins[1] = delay
+		}
+	}
+	if int32(delay-conn.delayMins[0]) < 0 {
+		conn.delayMins[0] = delay
+	}
+	baseDelay := conn.delayMins[0]
+	if int32(conn.delayMins[1]-baseDelay) < 0 {
+		baseDelay = conn.delayMins[1]
+	}
+
+	queuingDelay := float64(int32(delay - baseDelay))
+	delayFactor := (utpTargetDelay - queuingDelay) / utpTargetDelay
+	windowFactor := float64(bytesAcked) / conn.maxWindow
+	conn.maxWindow += utpMaxWindowIncrease * delayFactor * windowFactor
+
+	if conn.maxWindow < utpMinWindow {
+		conn.maxWindow = utpMinWindow
+	}
+	if conn.maxWindow > utpMaxWindow {
+		conn.maxWindow = utpMaxWindow
+	}
+}
+
+// Halves the congestion window after a lost packet
+func (conn *utpConn) onLoss() {
+	conn.maxWindow /= 2
+	if conn.maxWindow < utpMinWindow {
+		conn.maxWindow = utpMinWindow
+	}
+}
+
+// Stores a data packet, delivering it and the buffered packets that follow
+// once they are in order, and acknowledges it. Called with the lock held.
+func (conn *utpConn) handleData(packet *utpPacket) {
+	distance := int16(packet.seq - conn.ack)
+	if distance > 0 && distance <= utpMaxOutOfOrder && !conn.eof {
+		conn.outOfOrder[packet.seq] = packet
+		for {
+			next, ok := conn.outOfOrder[conn.ack+1]
+			if !ok {
+				break
+			}
+			delete(conn.outOfOrder, conn.ack+1)
+			conn.ack++
+			conn.readBuf = append(conn.readBuf, next.payload...)
+			if next.kind == utpFin {
+				conn.eof = true
+				conn.outOfOrder = make(map[uint16]*utpPacket)
+				break
+			}
+		}
+		conn.broadcast()
+	}
+
+	// Duplicates are acknowledged again, in case our ack was lost
+	conn.sendState()
+}
+
+// Checks the retransmission timeout, sends keep-alives and
+// gives up on closing connections, until the connection ends
+func (conn *utpConn) run() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		conn.mu.Lock()
+		conn.tick()
+		conn.mu.Unlock()
+	}
+}
+
+// Runs the periodic checks of the connection. Called with the lock held.
+func (conn *utpConn) tick() {
+	if conn.state == utpClosed {
+		return
+	}
+
+	if conn.closing && time.Since(conn.closeAt) > utpCloseTimeout {
+		conn.shutdown(net.ErrClosed)
+		return
+	}
+
+	// The oldest packet was not acknowledged in time, consider everything in flight lost
+	if len(conn.unacked) > 0 && time.Since(conn.unacked[0].sentAt) > conn.rto {
+		conn.timeouts++
+		if conn.timeouts > utpMaxTimeouts {
+			conn.shutdown(fmt.Errorf("uTP connection to %s timed out", conn.remote))
+			return
+		}
+		conn.rto *= 2
+		conn.maxWindow = utpMinWindow
+		for _, outgoing := range conn.unacked {
+			if outgoing.inFlight {
+				outgoing.inFlight = false
+				conn.inFlight -= len(outgoing.payload)
+			}
+			outgoing.needsResend = true
+		}
+
+		// The SYN is resent before the connection is established
+		if conn.state == utpSynSent {
+			conn.transmit(conn.unacked[0])
+		}
+		conn.flush()
+		return
+	}
+
+	if conn.state == utpConnected && time.Since(conn.lastSend) > utpKeepAliveInterval {
+		conn.sendState()
+	}
+}
+
+// Reads data received from the peer
+func (conn *utpConn) Read(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	for {
+		if len(conn.readBuf) > 0 {
+			n := copy(b, conn.readBuf)
+			conn.readBuf = conn.readBuf[n:]
+			return n, nil
+		}
+		if conn.eof {
+			return 0, io.EOF
+		}
+		if conn.closing {
+			return 0, net.ErrClosed
+		}
+		if conn.state == utpClosed {
+			return 0, conn.err
+		}
+		err := conn.wait(conn.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Queues data to be sent, blocking while the send buffer is full
+func (conn *utpConn) Write(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if conn.closing {
+			return written, net.ErrClosed
+		}
+		if conn.state == utpClosed {
+			return written, conn.err
+		}
+
+		space := utpSendBuffer - len(conn.sendBuf)
+		if space <= 0 {
+			err := conn.wait(conn.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		if space > len(b)-written {
+			space = len(b) - written
+		}
+		conn.sendBuf = append(conn.sendBuf, b[written:written+space]...)
+		written += space
+		conn.flush()
+	}
+	return written, nil
+}
+
+// Closes the connection. Data already written is sent before the FIN.
+func (conn *utpConn) Close() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.closing || conn.state == utpClosed {
+		return nil
+	}
+	conn.closing = true
+	conn.closeAt = time.Now()
+	conn.broadcast()
+
+	if conn.state == utpSynSent {
+		conn.shutdown(net.ErrClosed)
+		return nil
+	}
+	conn.flush()
+	return nil
+}
+
+func (conn *utpConn) LocalAddr() net.Addr {
+	return conn.socket.conn.LocalAddr()
+}
+
+func (conn *utpConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *utpConn) SetDeadline(deadline time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.readDeadline = deadline
+	conn.writeDeadline = deadline
+	conn.broadcast()
+	return nil
+}
+
+func (conn *utpConn) SetReadDeadline(deadline time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.readDeadline = deadline
+	conn.broadcast()
+	return nil
+}
+
+func (conn *utpConn) SetWriteDeadline(deadline time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.writeDeadline = deadline
+	conn.broadcast()
+	return nil
+}
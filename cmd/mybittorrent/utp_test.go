@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUtpPacketRoundTrip(t *testing.T) {
+	tests := []utpPacket{
+		{kind: utpSyn, connId: 0x1234, timestamp: 1, seq: 1},
+		{kind: utpData, connId: 7, timestamp: 0xdeadbeef, timestampDiff: 42, window: 1 << 20, seq: 0xffff, ack: 3, payload: []byte("hello")},
+		{kind: utpState, connId: 7, seq: 5, ack: 9, sack: []byte{0x03, 0x00, 0x00, 0x80}},
+		{kind: utpFin, connId: 65535, seq: 10, ack: 11, sack: []byte{0x01, 0x02, 0x04, 0x08}, payload: []byte{0}},
+		{kind: utpReset, connId: 1, seq: 2, ack: 3},
+	}
+
+	for _, test := range tests {
+		encoded := test.encode()
+		if version := encoded[0] & 0x0f; version != utpVersion {
+			t.Errorf("encoded version %d, want %d", version, utpVersion)
+		}
+		decoded, err := decodeUtpPacket(encoded)
+		if err != nil {
+			t.Errorf("decodeUtpPacket(%x) failed: %v", encoded, err)
+			continue
+		}
+		if len(decoded.payload) == 0 {
+			decoded.payload = nil
+		}
+		if !reflect.DeepEqual(*decoded, test) {
+			t.Errorf("decoded %+v, want %+v", *decoded, test)
+		}
+	}
+}
+
+func TestUtpPacketHeaderLayout(t *testing.T) {
+	packet := utpPacket{kind: utpData, connId: 0x0102, timestamp: 0x03040506, timestampDiff: 0x0708090a, window: 0x0b0c0d0e, seq: 0x0f10, ack: 0x1112, payload: []byte{0xff}}
+	want := []byte{0x01, 0, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0xff}
+	if got := packet.encode(); !bytes.Equal(got, want) {
+		t.Errorf("encode() = %x, want %x", got, want)
+	}
+
+	// A state packet with a selective ack: extension 1, then the terminating 0 and the length
+	packet = utpPacket{kind: utpState, sack: []byte{0xaa, 0xbb, 0xcc, 0xdd}}
+	got := packet.encode()
+	if got[0] != 0x21 || got[1] != utpSelectiveAck || !bytes.Equal(got[20:], []byte{0, 4, 0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Errorf("encode() = %x, want the selective ack extension after the header", got)
+	}
+}
+
+func TestDecodeUtpPacketExtensions(t *testing.T) {
+	header := (&utpPacket{kind: utpData, seq: 1}).encode()
+
+	// An unknown extension is skipped, then a selective ack, then the payload
+	data := append([]byte{}, header...)
+	data[1] = 9
+	data = append(data, utpSelectiveAck, 2, 0xee, 0xee)
+	data = append(data, 0, 4, 0x01, 0x00, 0x00, 0x00)
+	data = append(data, []byte("payload")...)
+	packet, err := decodeUtpPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.sack, []byte{1, 0, 0, 0}) || string(packet.payload) != "payload" {
+		t.Errorf("decoded sack %x and payload %q", packet.sack, packet.payload)
+	}
+
+	invalid := [][]byte{
+		header[:utpHeaderLen-1],
+		append([]byte{0x02}, header[1:]...),                                    // version 2
+		append([]byte{0x51}, header[1:]...),                                    // type 5
+		append(append([]byte{}, header[0], 1), header[2:]...),                  // extension without its header
+		append(append(append([]byte{}, header[0], 1), header[2:]...), 0, 4, 1), // truncated extension
+	}
+	for _, data := range invalid {
+		_, err := decodeUtpPacket(data)
+		if err == nil {
+			t.Errorf("decodeUtpPacket(%x) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+		{100, 65000, false},
+		{0, 32767, true},
+		{32768, 0, true},
+	}
+
+	for _, test := range tests {
+		if got := seqLess(test.a, test.b); got != test.less {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", test.a, test.b, got, test.less)
+		}
+	}
+}
+
+func TestSelectiveAckBitOrder(t *testing.T) {
+	tests := []struct {
+		ack      uint16
+		received []uint16
+		sack     []byte
+	}{
+		{10, nil, nil},
+		// Bit 0 of the first byte is ack + 2, bit 7 of the last byte is ack + 33
+		{10, []uint16{12}, []byte{0x01, 0, 0, 0}},
+		{10, []uint16{12, 13, 20, 43}, []byte{0x03, 0x01, 0, 0x80}},
+		{10, []uint16{19}, []byte{0x80, 0, 0, 0}},
+		{65534, []uint16{0, 1}, []byte{0x03, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		conn := newUtpConn(nil, nil, 1, 2)
+		conn.ack = test.ack
+		for _, seq := range test.received {
+			conn.outOfOrder[seq] = &utpPacket{seq: seq}
+		}
+		if got := conn.selectiveAck(); !bytes.Equal(got, test.sack) {
+			t.Errorf("ack %d, received %v: selectiveAck() = %x, want %x", test.ack, test.received, got, test.sack)
+		}
+	}
+}
+
+func TestHandleAckWithSelectiveAck(t *testing.T) {
+	conn := newUtpConn(nil, nil, 1, 2)
+	for seq := uint16(65533); seq != 4; seq++ {
+		conn.unacked = append(conn.unacked, &utpOutgoing{kind: utpData, seq: seq, payload: []byte{1}, sends: 1, sentAt: time.Now()})
+	}
+
+	// Everything up to 65534 is acknowledged, 65535 is missing, 0 and 2 arrived past it
+	conn.handleAck(&utpPacket{kind: utpState, ack: 65534, sack: []byte{0x05, 0, 0, 0}})
+
+	remaining := []uint16{}
+	for _, outgoing := range conn.unacked {
+		remaining = append(remaining, outgoing.seq)
+	}
+	if want := []uint16{65535, 1, 3}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("unacked %v, want %v", remaining, want)
+	}
+}
+
+func TestUtpLoopback(t *testing.T) {
+	listener, err := listenUTP(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer, err := listenUTP(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	// Larger than the send buffer, so that Write waits for acknowledgements
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf, _ := io.ReadAll(conn)
+		received <- buf
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: listener.Port()}
+	conn, err := dialer.dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want the %d bytes written", len(got), len(data))
+	}
+}
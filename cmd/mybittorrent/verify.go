@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sync"
+)
+
+// Exit codes of the verify command
+const (
+	VerifyComplete = 0 // all pieces match
+	VerifyError    = 1 // the content could not be checked
+	VerifyPartial  = 2 // some pieces match
+	VerifyMissing  = 3 // no piece matches
+)
+
+// Hash-checks the given pieces against the torrent using all CPU cores.
+// Returns the set of pieces whose data on disk is valid.
+func checkPieces(torrent *TorrentFile, storage *Storage, pieces []int) Bitmap {
+	valid := NewBitmap(torrent.NumPieces())
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	jobs := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				data, err := storage.ReadPiece(index)
+				if err != nil || !torrent.VerifyPiece(index, data) {
+					continue
+				}
+				mu.Lock()
+				valid.Set(index)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, index := range pieces {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	return valid
+}
+
+// Returns the range of pieces [first, last] covering a file
+func filePieces(torrent *TorrentFile, entry FileEntry) (int, int) {
+	first := entry.Offset / torrent.Info.PieceLen
+	last := (entry.Offset + entry.Length - 1) / torrent.Info.PieceLen
+	return first, last
+}
+
+// Verifies downloaded content against the piece hashes of a torrent,
+// printing the state of every piece and file. Like for download and seed,
+// contentPath is the file of a single-file torrent, and the directory
+// containing the directory named after the torrent for a multi-file torrent.
+// Returns the exit code of the verify command.
+func Verify(torrent *TorrentFile, contentPath string) int {
+	storage, err := OpenStorageReadOnly(torrent, contentPath)
+	if err != nil {
+		fmt.Println(err)
+		return VerifyError
+	}
+	defer storage.Close()
+
+	// Check every piece
+	piecesNum := torrent.NumPieces()
+	pieces := make([]int, piecesNum)
+	for i := range pieces {
+		pieces[i] = i
+	}
+	valid := checkPieces(torrent, storage, pieces)
+
+	for i := 0; i < piecesNum; i++ {
+		state := "ok"
+		if !valid.Has(i) {
+			state = "bad"
+		}
+		fmt.Printf("Piece %d: %s\n", i, state)
+	}
+
+	// A file is complete when it exists and all the pieces covering it are valid
+	for fileIndex, entry := range storage.files {
+		name := torrent.Info.Name
+		if torrent.Info.IsMultiFile() {
+			name = path.Join(torrent.Info.Files[fileIndex].Path...)
+		}
+
+		exists, fullLength := storage.hasFile(fileIndex)
+		if !exists {
+			fmt.Printf("File %s: missing\n", name)
+			continue
+		}
+
+		validPieces, totalPieces := 0, 0
+		if entry.entry.Length > 0 {
+			first, last := filePieces(torrent, entry.entry)
+			for i := first; i <= last; i++ {
+				totalPieces++
+				if valid.Has(i) {
+					validPieces++
+				}
+			}
+		}
+
+		state := "partial"
+		if validPieces == totalPieces && fullLength {
+			state = "complete"
+		} else if validPieces == 0 {
+			state = "missing"
+		}
+		fmt.Printf("File %s: %s (%d/%d pieces)\n", name, state, validPieces, totalPieces)
+	}
+
+	validNum := valid.Count()
+	fmt.Printf("Verified %d/%d pieces\n", validNum, piecesNum)
+
+	switch {
+	case validNum == piecesNum:
+		return VerifyComplete
+	case validNum == 0:
+		return VerifyMissing
+	default:
+		return VerifyPartial
+	}
+}
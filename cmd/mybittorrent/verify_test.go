@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a torrent named name with the given file contents, written under contentPath
+// as download would. A single content makes a single-file torrent.
+func verifyTorrent(t *testing.T, contentPath string, name string, contents ...string) *TorrentFile {
+	torrent := &TorrentFile{Info: Info{Name: name, PieceLen: 4}}
+	data := ""
+	for i, content := range contents {
+		if len(contents) > 1 {
+			torrent.Info.Files = append(torrent.Info.Files, File{Length: len(content), Path: []string{fmt.Sprintf("%d.txt", i)}})
+		}
+		data += content
+	}
+	torrent.Info.Length = len(data)
+	for i := 0; i < len(data); i += torrent.Info.PieceLen {
+		end := i + torrent.Info.PieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum([]byte(data[i:end]))
+		torrent.Info.Pieces = append(torrent.Info.Pieces, string(hash[:]))
+	}
+
+	for i, entry := range torrent.FileEntries(contentPath) {
+		err := os.MkdirAll(filepath.Dir(entry.Path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(entry.Path, []byte(contents[i]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return torrent
+}
+
+func TestVerifyContentPath(t *testing.T) {
+	dir := t.TempDir()
+
+	// A single-file torrent is verified against the file itself
+	filePath := filepath.Join(dir, "single.txt")
+	single := verifyTorrent(t, filePath, "single.txt", "hello world")
+	if code := Verify(single, filePath); code != VerifyComplete {
+		t.Errorf("Verify of the file = %d, want %d", code, VerifyComplete)
+	}
+	if code := Verify(single, filepath.Join(dir, "other.txt")); code != VerifyMissing {
+		t.Errorf("Verify of a missing file = %d, want %d", code, VerifyMissing)
+	}
+
+	// A multi-file torrent is verified against the directory holding the torrent directory
+	parent := filepath.Join(dir, "downloads")
+	multi := verifyTorrent(t, parent, "album", "first file", "second")
+	if code := Verify(multi, parent); code != VerifyComplete {
+		t.Errorf("Verify of the parent directory = %d, want %d", code, VerifyComplete)
+	}
+	if code := Verify(multi, filepath.Join(parent, "album")); code != VerifyMissing {
+		t.Errorf("Verify of the torrent directory itself = %d, want %d", code, VerifyMissing)
+	}
+
+	// Corrupt data is reported as partial
+	err := os.WriteFile(filepath.Join(parent, "album", "1.txt"), []byte("SECOND"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := Verify(multi, parent); code != VerifyPartial {
+		t.Errorf("Verify with a corrupt file = %d, want %d", code, VerifyPartial)
+	}
+}